@@ -0,0 +1,101 @@
+//go:build bedrock
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// awsSigner signs Bedrock requests with SigV4. Credentials come from the
+// AWS SDK's default chain: environment variables, the shared config and
+// credentials files (AWS_PROFILE, SSO), then container and instance roles.
+type awsSigner struct {
+	creds  aws.CredentialsProvider
+	region string
+	signer *v4.Signer
+}
+
+func newAWSSigner(ctx context.Context, region string) (*awsSigner, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("--style bedrock needs a region: use --region or set AWS_REGION")
+	}
+	return &awsSigner{creds: cfg.Credentials, region: cfg.Region, signer: v4.NewSigner()}, nil
+}
+
+// check fetches credentials once so a missing or expired setup fails before
+// the benchmark rather than in every run. The provider caches them and
+// refreshes them before they expire.
+func (s *awsSigner) check(ctx context.Context) error {
+	if s.creds == nil {
+		return errors.New("no AWS credentials found for --style bedrock; set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or AWS_PROFILE")
+	}
+	if _, err := s.creds.Retrieve(ctx); err != nil {
+		return fmt.Errorf("no AWS credentials found for --style bedrock; set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or AWS_PROFILE: %w", err)
+	}
+	return nil
+}
+
+// endpoint is the Bedrock runtime URL of the signer's region.
+func (s *awsSigner) endpoint() string {
+	return fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", s.region)
+}
+
+// transport wraps base so every request it sends is signed.
+func (s *awsSigner) transport(base http.RoundTripper) http.RoundTripper {
+	return &sigV4Transport{signer: s, base: base}
+}
+
+// sigV4Transport signs each request just before it is sent, so retries get
+// a fresh timestamp and credentials refreshed mid-run are picked up.
+type sigV4Transport struct {
+	signer *awsSigner
+	base   http.RoundTripper
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	creds, err := t.signer.creds.Retrieve(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving AWS credentials: %w", err)
+	}
+
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	signed.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	sum := sha256.Sum256(body)
+	if err := t.signer.signer.SignHTTP(req.Context(), creds, signed, hex.EncodeToString(sum[:]),
+		"bedrock", t.signer.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("error signing request: %w", err)
+	}
+	return t.base.RoundTrip(signed)
+}
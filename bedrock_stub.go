@@ -0,0 +1,29 @@
+//go:build !bedrock
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var errBedrockUnsupported = errors.New("Bedrock support is not compiled in; rebuild with -tags bedrock")
+
+type awsSigner struct{}
+
+func newAWSSigner(ctx context.Context, region string) (*awsSigner, error) {
+	return nil, errBedrockUnsupported
+}
+
+func (s *awsSigner) check(ctx context.Context) error {
+	return errBedrockUnsupported
+}
+
+func (s *awsSigner) endpoint() string {
+	return ""
+}
+
+func (s *awsSigner) transport(base http.RoundTripper) http.RoundTripper {
+	return base
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// cassetteEntry is one recorded request/response exchange. Cassettes are
+// stored as JSON lines, one entry per line, so they can be edited by hand.
+type cassetteEntry struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	RequestBody string      `json:"request_body"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        string      `json:"body"`
+}
+
+// recordingTransport forwards requests to base and appends every exchange to
+// a cassette. Response bodies are buffered in full before being handed back,
+// so streaming timings taken while recording are not representative.
+type recordingTransport struct {
+	base http.RoundTripper
+	mu   sync.Mutex
+	enc  *json.Encoder
+}
+
+func newRecordingTransport(base http.RoundTripper, w io.Writer) *recordingTransport {
+	return &recordingTransport{base: base, enc: json.NewEncoder(w)}
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(cassetteEntry{
+		Method:      req.Method,
+		URL:         cassetteURL(req.URL),
+		RequestBody: string(reqBody),
+		Status:      resp.StatusCode,
+		Header:      resp.Header,
+		Body:        string(body),
+	}); err != nil {
+		return nil, fmt.Errorf("error writing cassette: %w", err)
+	}
+	return resp, nil
+}
+
+// cassetteURL is a request URL as written to and matched against a
+// cassette. The key query parameter Gemini authenticates with is dropped so
+// the API key never ends up on disk and replays work with any key.
+func cassetteURL(u *url.URL) string {
+	q := u.Query()
+	if !q.Has("key") {
+		return u.String()
+	}
+	q.Del("key")
+	stripped := *u
+	stripped.RawQuery = q.Encode()
+	return stripped.String()
+}
+
+// replayTransport answers requests from a recorded cassette without touching
+// the network. Requests are matched on method, URL and body first and on
+// method and URL alone otherwise; repeated matches cycle through the
+// recorded responses in order.
+type replayTransport struct {
+	mu     sync.Mutex
+	byBody map[string][]cassetteEntry
+	byURL  map[string][]cassetteEntry
+	next   map[string]int
+}
+
+func loadCassette(path string) (*replayTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cassette: %w", err)
+	}
+	defer f.Close()
+
+	t := &replayTransport{
+		byBody: map[string][]cassetteEntry{},
+		byURL:  map[string][]cassetteEntry{},
+		next:   map[string]int{},
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e cassetteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error parsing cassette line %d: %w", line, err)
+		}
+		bodyKey := e.Method + " " + e.URL + "\n" + e.RequestBody
+		urlKey := e.Method + " " + e.URL
+		t.byBody[bodyKey] = append(t.byBody[bodyKey], e)
+		t.byURL[urlKey] = append(t.byURL[urlKey], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading cassette: %w", err)
+	}
+	if len(t.byURL) == 0 {
+		return nil, fmt.Errorf("cassette %s is empty", path)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	urlKey := req.Method + " " + cassetteURL(req.URL)
+	bodyKey := urlKey + "\n" + string(reqBody)
+
+	t.mu.Lock()
+	key, entries := bodyKey, t.byBody[bodyKey]
+	if len(entries) == 0 {
+		key, entries = urlKey, t.byURL[urlKey]
+	}
+	if len(entries) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no cassette entry for %s", urlKey)
+	}
+	e := entries[t.next[key]%len(entries)]
+	t.next[key]++
+	t.mu.Unlock()
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader([]byte(e.Body))),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile loads flag defaults from a --config YAML file whose keys
+// are flag names without the dashes. Flags given on the command line or
+// through their environment variable win over the file. Lists set
+// repeatable flags one element at a time; unknown keys are an error so a
+// typo doesn't silently leave a flag at its default, and so is setting a
+// flag under more than one of its names.
+func applyConfigFile(c *cli.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	// Map every flag name and alias to the flag's canonical name.
+	known := map[string]string{}
+	for _, f := range c.App.Flags {
+		names := f.Names()
+		for _, name := range names {
+			known[name] = names[0]
+		}
+	}
+	delete(known, "config")
+
+	keys := make([]string, 0, len(values))
+	var unknown []string
+	byFlag := map[string][]string{}
+	for key := range values {
+		name, ok := known[key]
+		if !ok {
+			unknown = append(unknown, key)
+		}
+		byFlag[name] = append(byFlag[name], key)
+		keys = append(keys, key)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+	// A flag set under both its name and an alias would take both values
+	// for a list, or whichever key sorts last for a scalar.
+	var duplicate []string
+	for _, names := range byFlag {
+		if len(names) > 1 {
+			sort.Strings(names)
+			duplicate = append(duplicate, strings.Join(names, "/"))
+		}
+	}
+	if len(duplicate) > 0 {
+		sort.Strings(duplicate)
+		return fmt.Errorf("duplicate keys in config file %s: %s", path, strings.Join(duplicate, ", "))
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := known[key]
+		if c.IsSet(name) {
+			continue
+		}
+		args, err := configArgs(values[key])
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+		for _, arg := range args {
+			if err := c.Set(name, arg); err != nil {
+				return fmt.Errorf("config file %s: invalid value %q for %s: %w", path, arg, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configArgs turns a YAML value into the command-line values it stands for:
+// one per list element, or just the one for a scalar.
+func configArgs(v any) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, fmt.Errorf("missing value")
+	case map[string]any:
+		return nil, fmt.Errorf("want a value or a list of values, not a mapping")
+	case []any:
+		args := make([]string, 0, len(v))
+		for _, elem := range v {
+			switch elem.(type) {
+			case nil, map[string]any, []any:
+				return nil, fmt.Errorf("list elements must be plain values")
+			}
+			args = append(args, fmt.Sprint(elem))
+		}
+		return args, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
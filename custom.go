@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// customStyle describes a JSON chat API none of the built-in styles speak:
+// a text/template that renders the request body and dotted paths into the
+// response for the reply and its token counts.
+type customStyle struct {
+	Body *template.Template
+	// ContentPath is required; without the token paths the counts fall
+	// back to the --tokenizer estimate.
+	ContentPath          string
+	PromptTokensPath     string
+	CompletionTokensPath string
+}
+
+// customRequest is what a --request-template is executed with.
+type customRequest struct {
+	Model     string
+	Messages  []chatMessage // the conversation so far, system prompt first
+	System    string        // the system prompt, or ""
+	Prompt    string        // the latest message
+	Flat      string        // every message joined by blank lines, for raw-text APIs
+	MaxTokens int
+	Stream    bool
+	Sampling  map[string]any // OpenAI field names
+}
+
+var customTemplateFuncs = template.FuncMap{
+	// json encodes a value, so strings arrive quoted and escaped.
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// newCustomStyle loads --request-template and checks the response paths.
+func newCustomStyle(templatePath, contentPath, promptTokensPath, completionTokensPath string) (*customStyle, error) {
+	if templatePath == "" {
+		return nil, errors.New("--style custom needs --request-template")
+	}
+	if contentPath == "" {
+		return nil, errors.New("--style custom needs --content-path")
+	}
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading request template: %w", err)
+	}
+	body, err := template.New(templatePath).Funcs(customTemplateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing request template: %w", err)
+	}
+	return &customStyle{
+		Body:                 body,
+		ContentPath:          contentPath,
+		PromptTokensPath:     promptTokensPath,
+		CompletionTokensPath: completionTokensPath,
+	}, nil
+}
+
+// payload renders the request body for one turn. It has to be a JSON
+// object so --tools and --param can be merged into it like into any other
+// style's body.
+func (cs *customStyle) payload(model string, messages []chatMessage, maxTokens int, stream bool, sampling map[string]any) (map[string]any, error) {
+	req := customRequest{
+		Model:     model,
+		Messages:  messages,
+		Flat:      completionPrompt(messages),
+		MaxTokens: maxTokens,
+		Stream:    stream,
+		Sampling:  sampling,
+	}
+	if len(messages) > 0 {
+		req.Prompt = messages[len(messages)-1].Content
+		if messages[0].Role == "system" {
+			req.System = messages[0].Content
+		}
+	}
+	var buf bytes.Buffer
+	if err := cs.Body.Execute(&buf, req); err != nil {
+		return nil, fmt.Errorf("error executing request template: %w", err)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &payload); err != nil {
+		return nil, fmt.Errorf("request template did not render a JSON object: %w", err)
+	}
+	return payload, nil
+}
+
+// parse extracts the reply and token counts from a non-streamed response.
+func (cs *customStyle) parse(raw []byte) (apiResponse, error) {
+	var body any
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return apiResponse{}, err
+	}
+	v, ok := jsonPath(body, cs.ContentPath)
+	if !ok {
+		excerpt := strings.TrimSpace(string(raw))
+		if r := []rune(excerpt); len(r) > 80 {
+			excerpt = string(r[:80]) + "…"
+		}
+		return apiResponse{}, fmt.Errorf("response has no %s: %s", cs.ContentPath, excerpt)
+	}
+	content, ok := v.(string)
+	if !ok {
+		return apiResponse{}, fmt.Errorf("%s is %T, not a string", cs.ContentPath, v)
+	}
+	var usage usageBlock
+	for _, f := range []struct {
+		path string
+		n    *int
+	}{
+		{cs.PromptTokensPath, &usage.PromptTokens},
+		{cs.CompletionTokensPath, &usage.CompletionTokens},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if n, ok := jsonPath(body, f.path); ok {
+			if count, ok := n.(float64); ok {
+				*f.n = int(count)
+			}
+		}
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return apiResponse{Content: content, Usage: usage}, nil
+}
+
+// jsonPath looks up a dotted path such as choices.0.message.content in a
+// decoded JSON value. A leading "$." and bracketed indexes (choices[0])
+// are accepted too, so JSONPath-style paths copied from elsewhere work.
+func jsonPath(v any, path string) (any, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
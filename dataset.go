@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// promptDataset is the prompt pool loaded by --prompt-dataset. Each run
+// sends one prompt from it instead of the same --prompt every time, so
+// server-side prompt caching doesn't flatter the results.
+type promptDataset struct {
+	prompts []string
+	random  bool
+}
+
+// loadPromptDataset reads one prompt per line. Lines that are JSON objects
+// with a "prompt" field (JSONL) use that field; blank lines are skipped.
+func loadPromptDataset(path, sampling string) (*promptDataset, error) {
+	d := &promptDataset{}
+	switch sampling {
+	case "round-robin":
+	case "random":
+		d.random = true
+	default:
+		return nil, fmt.Errorf("invalid prompt sampling %q: want round-robin or random", sampling)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening prompt dataset: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "{") {
+			var rec struct {
+				Prompt *string `json:"prompt"`
+			}
+			if err := json.Unmarshal([]byte(text), &rec); err != nil {
+				return nil, fmt.Errorf("error parsing prompt dataset line %d: %w", line, err)
+			}
+			if rec.Prompt == nil {
+				return nil, fmt.Errorf("prompt dataset line %d has no \"prompt\" field", line)
+			}
+			text = *rec.Prompt
+		}
+		d.prompts = append(d.prompts, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading prompt dataset: %w", err)
+	}
+	if len(d.prompts) == 0 {
+		return nil, fmt.Errorf("prompt dataset %s contains no prompts", path)
+	}
+	return d, nil
+}
+
+// pick returns the index of the prompt for a run: runs cycle through the
+// dataset in order, or draw from rng with random sampling.
+func (d *promptDataset) pick(run int, rng *rand.Rand) int {
+	if d.random {
+		return rng.Intn(len(d.prompts))
+	}
+	return (run - 1) % len(d.prompts)
+}
+
+func (d *promptDataset) String() string {
+	mode := "round-robin"
+	if d.random {
+		mode = "random"
+	}
+	return fmt.Sprintf("%d prompts, %s", len(d.prompts), mode)
+}
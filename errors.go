@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// errorTracker counts failed requests by category (transport, timeout,
+// http-<status>, json_parse, api, grpc) and keeps the first message seen
+// for each, so the summary shows what kind of failures a run had and an
+// example to start debugging from.
+type errorTracker struct {
+	mu     sync.Mutex
+	counts map[string]int
+	first  map[string]string
+}
+
+// errorCount is one category of the error breakdown.
+type errorCount struct {
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+	Example  string `json:"example"`
+}
+
+func newErrorTracker() *errorTracker {
+	return &errorTracker{counts: map[string]int{}, first: map[string]string{}}
+}
+
+// transportCategory tells timeouts apart from other transport errors.
+func transportCategory(err error) string {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	return "transport"
+}
+
+func (t *errorTracker) record(category, message string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts[category] == 0 {
+		if r := []rune(message); len(r) > 200 {
+			message = string(r[:200]) + "…"
+		}
+		t.first[category] = message
+	}
+	t.counts[category]++
+}
+
+// breakdown returns the categories, most frequent first.
+func (t *errorTracker) breakdown() []errorCount {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]errorCount, 0, len(t.counts))
+	for category, n := range t.counts {
+		out = append(out, errorCount{Category: category, Count: n, Example: t.first[category]})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Category < out[j].Category
+	})
+	return out
+}
+
+func writeErrors(w io.Writer, format string, errs []errorCount) {
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### Errors\n\n")
+		rows := make([][]string, len(errs))
+		for i, e := range errs {
+			rows[i] = []string{e.Category, fmt.Sprint(e.Count), e.Example}
+		}
+		writeMarkdownTable(w, []string{"Category", "Count", "First error"}, rows)
+		return
+	}
+	fmt.Fprintf(w, "\n=== Errors ===\n")
+	for _, e := range errs {
+		fmt.Fprintf(w, "%-25s: %d (first: %s)\n", e.Category, e.Count, e.Example)
+	}
+}
+
+// statusTracker counts HTTP responses by status code, 200s and retried
+// attempts included, so the summary shows whether a gateway sheds load
+// with 503s or rate-limits with 429s.
+type statusTracker struct {
+	mu     sync.Mutex
+	counts map[int]int
+}
+
+// statusCount is one row of the status code histogram.
+type statusCount struct {
+	Code  int `json:"code"`
+	Count int `json:"count"`
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{counts: map[int]int{}}
+}
+
+func (t *statusTracker) record(code int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counts[code]++
+}
+
+// histogram returns the status codes in ascending order.
+func (t *statusTracker) histogram() []statusCount {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]statusCount, 0, len(t.counts))
+	for code, n := range t.counts {
+		out = append(out, statusCount{Code: code, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Code < out[j].Code })
+	return out
+}
+
+func writeStatusCodes(w io.Writer, format string, codes []statusCount) {
+	var total int
+	for _, c := range codes {
+		total += c.Count
+	}
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### Status codes\n\n")
+		rows := make([][]string, len(codes))
+		for i, c := range codes {
+			rows[i] = []string{fmt.Sprint(c.Code), fmt.Sprint(c.Count), fmt.Sprintf("%.1f%%", 100*float64(c.Count)/float64(total))}
+		}
+		writeMarkdownTable(w, []string{"Status", "Responses", "Share"}, rows)
+		return
+	}
+	fmt.Fprintf(w, "\n=== Status codes ===\n")
+	for _, c := range codes {
+		fmt.Fprintf(w, "%-25d: %d (%.1f%%)\n", c.Code, c.Count, 100*float64(c.Count)/float64(total))
+	}
+}
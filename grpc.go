@@ -0,0 +1,226 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// KServe v2 / Triton inference method. Messages are encoded by hand with
+// protowire so we don't have to vendor the generated stubs.
+const grpcInferMethod = "/inference.GRPCInferenceService/ModelInfer"
+
+type grpcClient struct {
+	conn *grpc.ClientConn
+	key  string
+	opts grpcOptions
+}
+
+// rawCodec passes already-encoded protobuf bytes through untouched.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: unexpected type %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: unexpected type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+func newGRPCClient(target, key string, opts grpcOptions) (*grpcClient, error) {
+	creds := insecure.NewCredentials()
+	switch {
+	case strings.HasPrefix(target, "https://"):
+		target = strings.TrimPrefix(target, "https://")
+		creds = credentials.NewClientTLSFromCert(nil, "")
+	case strings.HasPrefix(target, "grpc://"):
+		target = strings.TrimPrefix(target, "grpc://")
+	case strings.HasPrefix(target, "http://"):
+		target = strings.TrimPrefix(target, "http://")
+	}
+	target = strings.TrimRight(target, "/")
+
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", target, err)
+	}
+	return &grpcClient{conn: conn, key: key, opts: opts}, nil
+}
+
+func (g *grpcClient) Close() error {
+	return g.conn.Close()
+}
+
+// infer sends a single ModelInfer request with the prompt as a BYTES tensor
+// and returns the decoded text of the configured output tensor.
+func (g *grpcClient) infer(ctx context.Context, model, prompt string, maxTokens int) (string, error) {
+	req := encodeInferRequest(model, prompt, maxTokens, g.opts)
+	if g.key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+g.key)
+	}
+
+	var resp []byte
+	if err := g.conn.Invoke(ctx, grpcInferMethod, &req, &resp, grpc.ForceCodec(rawCodec{})); err != nil {
+		return "", err
+	}
+	return decodeInferResponse(resp, g.opts.OutputName)
+}
+
+func encodeInferRequest(model, prompt string, maxTokens int, opts grpcOptions) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType) // model_name
+	b = protowire.AppendString(b, model)
+
+	// InferTensorContents.bytes_contents = 8
+	var text []byte
+	text = protowire.AppendTag(text, 8, protowire.BytesType)
+	text = protowire.AppendString(text, prompt)
+	b = protowire.AppendTag(b, 5, protowire.BytesType) // inputs
+	b = protowire.AppendBytes(b, encodeInputTensor(opts.InputName, "BYTES", text))
+
+	if opts.MaxTokensInput != "" && maxTokens > 0 {
+		// InferTensorContents.int_contents = 2 (packed)
+		var n []byte
+		n = protowire.AppendTag(n, 2, protowire.BytesType)
+		n = protowire.AppendBytes(n, protowire.AppendVarint(nil, uint64(maxTokens)))
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeInputTensor(opts.MaxTokensInput, "INT32", n))
+	}
+
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.BytesType) // name
+	out = protowire.AppendString(out, opts.OutputName)
+	b = protowire.AppendTag(b, 6, protowire.BytesType) // outputs
+	b = protowire.AppendBytes(b, out)
+	return b
+}
+
+func encodeInputTensor(name, datatype string, contents []byte) []byte {
+	var shape []byte
+	shape = protowire.AppendVarint(shape, 1)
+	shape = protowire.AppendVarint(shape, 1)
+
+	var t []byte
+	t = protowire.AppendTag(t, 1, protowire.BytesType) // name
+	t = protowire.AppendString(t, name)
+	t = protowire.AppendTag(t, 2, protowire.BytesType) // datatype
+	t = protowire.AppendString(t, datatype)
+	t = protowire.AppendTag(t, 3, protowire.BytesType) // shape (packed)
+	t = protowire.AppendBytes(t, shape)
+	t = protowire.AppendTag(t, 5, protowire.BytesType) // contents
+	t = protowire.AppendBytes(t, contents)
+	return t
+}
+
+// decodeInferResponse pulls the named output out of a ModelInferResponse.
+// Triton normally answers with raw_output_contents (length-prefixed BYTES
+// elements); other servers fill outputs[].contents.bytes_contents instead.
+func decodeInferResponse(b []byte, outputName string) (string, error) {
+	var outputs [][]byte
+	var raw [][]byte
+	if err := walkFields(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 5:
+			outputs = append(outputs, v)
+		case 6:
+			raw = append(raw, v)
+		}
+	}); err != nil {
+		return "", err
+	}
+
+	for i, o := range outputs {
+		var name string
+		var contents []byte
+		if err := walkFields(o, func(num protowire.Number, v []byte) {
+			switch num {
+			case 1:
+				name = string(v)
+			case 5:
+				contents = v
+			}
+		}); err != nil {
+			return "", err
+		}
+		if name != outputName {
+			continue
+		}
+		if i < len(raw) {
+			return decodeRawBytes(raw[i])
+		}
+		var parts []string
+		if err := walkFields(contents, func(num protowire.Number, v []byte) {
+			if num == 8 {
+				parts = append(parts, string(v))
+			}
+		}); err != nil {
+			return "", err
+		}
+		return strings.Join(parts, ""), nil
+	}
+	return "", fmt.Errorf("output %q not found in response", outputName)
+}
+
+// walkFields calls fn for every length-delimited field in b and skips the rest.
+func walkFields(b []byte, fn func(protowire.Number, []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			fn(num, v)
+			b = b[m:]
+			continue
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func decodeRawBytes(b []byte) (string, error) {
+	var sb strings.Builder
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return "", errors.New("truncated BYTES element in raw output")
+		}
+		n := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return "", errors.New("truncated BYTES element in raw output")
+		}
+		sb.Write(b[:n])
+		b = b[n:]
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,24 @@
+//go:build !grpc
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errGRPCUnsupported = errors.New("gRPC support is not compiled in; rebuild with -tags grpc")
+
+type grpcClient struct{}
+
+func newGRPCClient(target, key string, opts grpcOptions) (*grpcClient, error) {
+	return nil, errGRPCUnsupported
+}
+
+func (g *grpcClient) Close() error {
+	return nil
+}
+
+func (g *grpcClient) infer(ctx context.Context, model, prompt string, maxTokens int) (string, error) {
+	return "", errGRPCUnsupported
+}
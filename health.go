@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// healthMonitor probes the endpoint on a side goroutine while a benchmark
+// runs and logs when it goes down and comes back, so an outage can be told
+// apart from gradual degradation. A probe is healthy when it answers 2xx.
+type healthMonitor struct {
+	client   *http.Client
+	url      string
+	key      string
+	interval time.Duration
+
+	mu        sync.Mutex
+	downSince time.Time // zero while healthy
+	unhealthy time.Duration
+	outages   int
+	probes    int
+	failures  int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newHealthMonitor resolves path against baseURL, so "/health" hits the
+// server root and a relative path stays under the API prefix. Probes get
+// their own connection pool to keep them out of the connection-reuse stats.
+func newHealthMonitor(baseURL, path, key string, interval time.Duration, tlsConfig *tls.Config) (*healthMonitor, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health path %q: %w", path, err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &healthMonitor{
+		client: &http.Client{
+			Timeout:   interval,
+			Transport: transport,
+		},
+		url:      base.ResolveReference(ref).String(),
+		key:      key,
+		interval: interval,
+	}, nil
+}
+
+func (h *healthMonitor) start(ctx context.Context) {
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.done = make(chan struct{})
+	infof("Health | probing %s every %s", h.url, h.interval)
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		h.probe(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.probe(ctx)
+			}
+		}
+	}()
+}
+
+func (h *healthMonitor) probe(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.url, nil)
+	if err != nil {
+		return
+	}
+	if h.key != "" {
+		req.Header.Set("Authorization", "Bearer "+h.key)
+	}
+	var reason string
+	resp, err := h.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		reason = err.Error()
+	} else {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			reason = fmt.Sprintf("status %d", resp.StatusCode)
+		}
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probes++
+	switch {
+	case reason != "" && h.downSince.IsZero():
+		h.failures++
+		h.outages++
+		h.downSince = now
+		warnf("Health | unhealthy | %s", reason)
+	case reason != "":
+		h.failures++
+	case !h.downSince.IsZero():
+		down := now.Sub(h.downSince)
+		h.unhealthy += down
+		h.downSince = time.Time{}
+		infof("Health | recovered | down for %s", down.Round(time.Millisecond))
+	}
+}
+
+// stop ends probing and returns the total unhealthy time, counting an
+// outage still open at the end, along with the outage and probe counts.
+func (h *healthMonitor) stop() (unhealthy time.Duration, outages, probes, failures int) {
+	h.cancel()
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unhealthy = h.unhealthy
+	if !h.downSince.IsZero() {
+		unhealthy += time.Since(h.downSince)
+	}
+	return unhealthy, h.outages, h.probes, h.failures
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+func init() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+}
+
+// logLevel is the least severe level that gets logged, set by --log-level
+// and --quiet. Lines below it are dropped before they are formatted, so a
+// quiet 10k-request run doesn't serialize its workers on the logger.
+var logLevel = slog.LevelInfo
+
+// parseLogLevel parses --log-level: info logs every run's events, warn
+// only retries, anomalies and errors, error only errors.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log-level %q (expected info, warn or error)", s)
+}
+
+// eventLevel is the level of a per-run event: failures are errors, events
+// that point at a problem without failing the run are warnings, and the
+// routine request, stream-start, success and *-stored events are info.
+func eventLevel(event string) slog.Level {
+	switch event {
+	case "error":
+		return slog.LevelError
+	case "retry", "retry-skipped", "usage-missing", "stream-malformed":
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// logJSON, when set by --log-format json, writes every log line as one
+// JSON object instead of the human format: run events with the run, event
+// and fields as attributes, other lines as a message.
+var logJSON *slog.Logger
+
+// logOutput forwards to the standard logger's current writer, which the
+// progress line takes over while it is shown.
+type logOutput struct{}
+
+func (logOutput) Write(b []byte) (int, error) {
+	return log.Writer().Write(b)
+}
+
+func newJSONLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(logOutput{}, &slog.HandlerOptions{Level: logLevel}))
+}
+
+type logFields map[string]any
+
+func logEvent(run int, event string, fields logFields) {
+	level := eventLevel(event)
+	if level < logLevel {
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if logJSON != nil {
+		attrs := make([]slog.Attr, 0, len(fields)+2)
+		attrs = append(attrs, slog.Int("run", run), slog.String("event", event))
+		for _, k := range keys {
+			// Run metrics carry the run number too.
+			if k != "run" {
+				attrs = append(attrs, slog.Any(k, fields[k]))
+			}
+		}
+		logJSON.LogAttrs(context.Background(), level, event, attrs...)
+		return
+	}
+	parts := make([]string, 0, len(fields)+2)
+	parts = append(parts, fmt.Sprintf("Run %03d", run), event)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	log.Println(strings.Join(parts, " | "))
+}
+
+// infof logs a line about the benchmark as a whole, such as its setup or a
+// phase change.
+func infof(format string, args ...any) {
+	if slog.LevelInfo < logLevel {
+		return
+	}
+	if logJSON != nil {
+		logJSON.Info(fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// warnf logs a problem that doesn't stop the benchmark; only --log-level
+// error drops it.
+func warnf(format string, args ...any) {
+	if slog.LevelWarn < logLevel {
+		return
+	}
+	if logJSON != nil {
+		// The level says it; the human format's prefix would be noise.
+		logJSON.Warn(strings.TrimPrefix(fmt.Sprintf(format, args...), "Warning: "))
+		return
+	}
+	log.Printf(format, args...)
+}
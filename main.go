@@ -4,24 +4,48 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
 type usageBlock struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// Reasoning models (o1, deepseek-r1 on some servers) report the hidden
+	// reasoning part of the completion tokens here.
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
 }
 
 type successResp struct {
@@ -31,6 +55,7 @@ type successResp struct {
 			Role    string `json:"role"`
 			Content string `json:"content"`
 		} `json:"message"`
+		Text string `json:"text"` // legacy /completions
 	} `json:"choices"`
 }
 
@@ -43,464 +68,3868 @@ type ollamaResp struct {
 		Role    string `json:"role"`
 		Content string `json:"content"`
 	} `json:"message"`
+	LoadDuration       int64 `json:"load_duration"`
+	PromptEvalCount    int   `json:"prompt_eval_count"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration"`
+	EvalCount          int   `json:"eval_count"`
+	EvalDuration       int64 `json:"eval_duration"`
+}
+
+type anthropicResp struct {
+	Type    string `json:"type"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// cohereResp is a Cohere v1 chat reply, or an error carrying only message.
+// It is also the response of the stream-end event.
+type cohereResp struct {
+	Text    string `json:"text"`
+	Message string `json:"message"`
+	Meta    struct {
+		// Token counts are JSON numbers that Cohere's own SDKs read as
+		// floats.
+		Tokens struct {
+			InputTokens  float64 `json:"input_tokens"`
+			OutputTokens float64 `json:"output_tokens"`
+		} `json:"tokens"`
+	} `json:"meta"`
+}
+
+func (r cohereResp) usage() usageBlock {
+	in, out := int(r.Meta.Tokens.InputTokens), int(r.Meta.Tokens.OutputTokens)
+	return usageBlock{PromptTokens: in, CompletionTokens: out, TotalTokens: in + out}
+}
+
+// bedrockResp covers the InvokeModel replies of both model families
+// --style bedrock supports: Claude's Messages format and Titan Text's.
+type bedrockResp struct {
+	anthropicResp
+	InputTextTokenCount int `json:"inputTextTokenCount"`
+	Results             []struct {
+		TokenCount int    `json:"tokenCount"`
+		OutputText string `json:"outputText"`
+	} `json:"results"`
+}
+
+type geminiResp struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"content"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// text joins the parts of the first candidate.
+func (r geminiResp) text() string {
+	if len(r.Candidates) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, part := range r.Candidates[0].Content.Parts {
+		b.WriteString(part.Text)
+	}
+	return b.String()
+}
+
+type modelsResp struct {
+	// OpenAI: { "data": [ { "id": "..." } ] }
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+	// Ollama and Cohere: { "models": [ { "name": "..." } ] }
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
 }
 
 type runMetrics struct {
-	Run              int     `json:"run"`
-	Model            string  `json:"model"`
-	Stream           bool    `json:"stream"`
-	PromptTokens     int     `json:"prompt_tokens"`
-	CompletionTokens int     `json:"completion_tokens"`
-	TotalTokens      int     `json:"total_tokens"`
-	LatencyMs        float64 `json:"latency_ms"`
-	TokPerSec        float64 `json:"tok_per_sec"`
+	Run                 int     `json:"run"`
+	Turn                int     `json:"turn,omitempty"`
+	Model               string  `json:"model"`
+	Stream              bool    `json:"stream"`
+	PromptTokens        int     `json:"prompt_tokens"`
+	CompletionTokens    int     `json:"completion_tokens"`
+	ReasoningTokens     int     `json:"reasoning_tokens,omitempty"` // part of CompletionTokens
+	TotalTokens         int     `json:"total_tokens"`
+	TokenSource         string  `json:"token_source,omitempty"`
+	CostUSD             float64 `json:"cost_usd,omitempty"`
+	LatencyMs           float64 `json:"latency_ms"`
+	TokPerSec           float64 `json:"tok_per_sec"`
+	CompletionTokPerSec float64 `json:"completion_tok_per_sec"`
+	TotalTokPerSec      float64 `json:"total_tok_per_sec"`
+	PromptTokPerSec     float64 `json:"prompt_tok_per_sec"`
+	PromptTPSBasis      string  `json:"prompt_tps_basis"` // prompt_eval, ttft or latency
+	TTFTMs              float64 `json:"ttft_ms"`
+	ITLMeanMs           float64 `json:"itl_mean_ms"`
+	ITLP95Ms            float64 `json:"itl_p95_ms"`
+	PrefillMs           float64 `json:"prefill_ms"`
+	DecodeMs            float64 `json:"decode_ms"`
+	// Ollama's server-side timings; zero for other styles and for Ollama
+	// versions that don't report them.
+	LoadDurationMs       float64   `json:"load_duration_ms,omitempty"`
+	PromptEvalDurationMs float64   `json:"prompt_eval_duration_ms,omitempty"`
+	EvalDurationMs       float64   `json:"eval_duration_ms,omitempty"`
+	MaxTokens            int       `json:"max_tokens"`
+	PromptIndex          *int      `json:"prompt_index,omitempty"`
+	StatusCode           int       `json:"status_code"`
+	Retries              int       `json:"retries"`
+	RateLimitRemaining   *int      `json:"ratelimit_remaining,omitempty"`
+	ServerTimeMs         float64   `json:"server_time_ms"`
+	ConnReused           bool      `json:"conn_reused"`
+	ConnectMs            float64   `json:"connect_ms"`
+	ReqBytes             int64     `json:"req_bytes"`
+	RespBytes            int64     `json:"resp_bytes"` // decoded size for compressed responses
+	RateUndefined        bool      `json:"rate_undefined,omitempty"`
+	Cancelled            bool      `json:"cancelled,omitempty"` // stream cut off by an abort; not a success
+	StartedAt            time.Time `json:"started_at"`
 }
 
 func (rm runMetrics) ToMap() map[string]any {
-	return map[string]any{
-		"run":               rm.Run,
-		"model":             rm.Model,
-		"stream":            rm.Stream,
-		"prompt_tokens":     rm.PromptTokens,
-		"completion_tokens": rm.CompletionTokens,
-		"total_tokens":      rm.TotalTokens,
-		"latency_ms":        rm.LatencyMs,
-		"tok_per_sec":       rm.TokPerSec,
+	m := map[string]any{
+		"run":                    rm.Run,
+		"model":                  rm.Model,
+		"stream":                 rm.Stream,
+		"prompt_tokens":          rm.PromptTokens,
+		"completion_tokens":      rm.CompletionTokens,
+		"total_tokens":           rm.TotalTokens,
+		"latency_ms":             rm.LatencyMs,
+		"tok_per_sec":            rm.TokPerSec,
+		"completion_tok_per_sec": rm.CompletionTokPerSec,
+		"total_tok_per_sec":      rm.TotalTokPerSec,
+		"prompt_tok_per_sec":     rm.PromptTokPerSec,
+		"prompt_tps_basis":       rm.PromptTPSBasis,
+		"ttft_ms":                rm.TTFTMs,
+		"itl_mean_ms":            rm.ITLMeanMs,
+		"itl_p95_ms":             rm.ITLP95Ms,
+		"prefill_ms":             rm.PrefillMs,
+		"decode_ms":              rm.DecodeMs,
+		"max_tokens":             rm.MaxTokens,
+		"status_code":            rm.StatusCode,
+		"retries":                rm.Retries,
+		"server_time_ms":         rm.ServerTimeMs,
+		"conn_reused":            rm.ConnReused,
+		"connect_ms":             rm.ConnectMs,
+		"req_bytes":              rm.ReqBytes,
+		"resp_bytes":             rm.RespBytes,
+	}
+	if rm.RateLimitRemaining != nil {
+		m["ratelimit_remaining"] = *rm.RateLimitRemaining
+	}
+	if rm.Turn > 0 {
+		m["turn"] = rm.Turn
+	}
+	if rm.PromptIndex != nil {
+		m["prompt_index"] = *rm.PromptIndex
+	}
+	if rm.EvalDurationMs > 0 {
+		m["load_duration_ms"] = rm.LoadDurationMs
+		m["prompt_eval_duration_ms"] = rm.PromptEvalDurationMs
+		m["eval_duration_ms"] = rm.EvalDurationMs
+	}
+	if rm.CostUSD > 0 {
+		m["cost_usd"] = rm.CostUSD
+	}
+	if rm.RateUndefined {
+		m["rate_undefined"] = true
+	}
+	if rm.Cancelled {
+		m["cancelled"] = true
+	}
+	if rm.TokenSource != "" {
+		m["token_source"] = rm.TokenSource
+	}
+	if rm.ReasoningTokens > 0 {
+		m["reasoning_tokens"] = rm.ReasoningTokens
+	}
+	return m
+}
+
+// setRates computes the per-run throughput figures. The canonical rate is
+// completion tokens over decode time (latency minus TTFT when streaming, the
+// server's eval_duration for Ollama, full latency when neither is known), so
+// it means the same thing for every style. TotalTokPerSec counts prompt and
+// completion tokens over the full latency. mode picks which of the two is
+// reported as the headline TokPerSec.
+//
+// PromptTokPerSec is prompt tokens over the best prefill time available,
+// recorded in PromptTPSBasis: Ollama's prompt_eval_duration, else TTFT when
+// streaming, else the full latency, which also includes decoding and so
+// understates prefill speed.
+//
+// A rate whose time is zero, as for a local response faster than the
+// clock's resolution, is left at zero and the run is marked RateUndefined
+// so the aggregates skip its rates instead of averaging in an Inf. So is a
+// reply without completion tokens, whose 0 tok/s says nothing about speed.
+func (rm *runMetrics) setRates(mode string) {
+	secs := rm.LatencyMs / 1e3
+	decodeSecs := secs
+	if rm.DecodeMs > 0 {
+		decodeSecs = rm.DecodeMs / 1e3
+	}
+	var completionOK, totalOK, promptOK bool
+	rm.CompletionTokPerSec, completionOK = perSecond(float64(rm.CompletionTokens), decodeSecs)
+	rm.TotalTokPerSec, totalOK = perSecond(float64(rm.TotalTokens), secs)
+	prefillSecs := secs
+	switch {
+	case rm.PromptEvalDurationMs > 0:
+		prefillSecs, rm.PromptTPSBasis = rm.PromptEvalDurationMs/1e3, "prompt_eval"
+	case rm.TTFTMs > 0:
+		prefillSecs, rm.PromptTPSBasis = rm.TTFTMs/1e3, "ttft"
+	default:
+		rm.PromptTPSBasis = "latency"
 	}
+	rm.PromptTokPerSec, promptOK = perSecond(float64(rm.PromptTokens), prefillSecs)
+	rm.RateUndefined = !completionOK || !totalOK || !promptOK || rm.CompletionTokens == 0
+	if mode == "completion" {
+		rm.TokPerSec = rm.CompletionTokPerSec
+	} else {
+		rm.TokPerSec = rm.TotalTokPerSec
+	}
+}
+
+// perSecond returns n per second over secs. With no time to divide by it
+// returns 0 and false, unless there is nothing to count either.
+func perSecond(n, secs float64) (float64, bool) {
+	if n == 0 {
+		return 0, true
+	}
+	rate := n / secs
+	if secs <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, false
+	}
+	return rate, true
+}
+
+// promptTPSBasisLabel describes the denominators behind a mean prompt
+// tok/s, with counts when the runs mixed several.
+func promptTPSBasisLabel(bases map[string]int) string {
+	names := map[string]string{
+		"prompt_eval": "prompt_eval_duration",
+		"ttft":        "TTFT",
+		"latency":     "full latency",
+	}
+	var parts []string
+	for _, basis := range []string{"prompt_eval", "ttft", "latency"} {
+		if bases[basis] == 0 {
+			continue
+		}
+		if len(bases) == 1 {
+			return names[basis]
+		}
+		parts = append(parts, fmt.Sprintf("%s for %d", names[basis], bases[basis]))
+	}
+	return strings.Join(parts, ", ")
 }
 
-type logFields map[string]any
+// turnKind prefixes a stored file's data type with the session turn so the
+// turns of one run don't overwrite each other.
+func turnKind(turn int, kind string) string {
+	if turn <= 1 {
+		return kind
+	}
+	return fmt.Sprintf("turn%d.%s", turn, kind)
+}
 
-func storeRunData(dataDir string, run int, dataType string, content string) (error, string) {
+func storeRunData(dataDir string, run int, dataType string, content string) (string, error) {
 	filename := fmt.Sprintf("%s/%03d.%s.txt", dataDir, run, dataType)
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return fmt.Errorf("error creating directory %s: %w", dataDir, err), filename
+		return filename, fmt.Errorf("error creating directory %s: %w", dataDir, err)
 	}
 	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
-		return fmt.Errorf("error writing %s: %w", filename, err), filename
+		return filename, fmt.Errorf("error writing %s: %w", filename, err)
 	}
-	return nil, filename
+	return filename, nil
 }
 
-func logEvent(run int, event string, fields logFields) {
-	parts := make([]string, 0, len(fields)+2)
-	parts = append(parts, fmt.Sprintf("Run %03d", run), event)
-	keys := make([]string, 0, len(fields))
-	for k := range fields {
-		keys = append(keys, k)
+// persistRun stores a successful turn's reply and metrics for --store-data.
+// Failures are logged rather than returned so that a full disk doesn't turn
+// a successful run into a failed one.
+func persistRun(dataDir string, run, turn int, responseText string, m runMetrics) {
+	filename, err := storeRunData(dataDir, run, turnKind(turn, "response"), responseText)
+	if err != nil {
+		logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
+	}
+	logEvent(run, "response-stored", logFields{"file": filename})
+	data, err := json.Marshal(m)
+	if err != nil {
+		logEvent(run, "error", logFields{"type": "json_marshal", "error": err.Error()})
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	filename, err = storeRunData(dataDir, run, turnKind(turn, "metrics"), string(data))
+	if err != nil {
+		logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
 	}
-	log.Println(strings.Join(parts, " | "))
+	logEvent(run, "metrics-stored", logFields{"file": filename})
 }
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+// persistError stores the status code and body of a turn the server
+// answered with an error status, so --store-data leaves a trail of what
+// flaky endpoints sent back.
+func persistError(dataDir string, run, turn, status int, body string) {
+	filename, err := storeRunData(dataDir, run, turnKind(turn, "error"), fmt.Sprintf("status: %d\n\n%s", status, body))
+	if err != nil {
+		logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
+	}
+	logEvent(run, "error-stored", logFields{"file": filename})
 }
 
-func countTokens(text string) int {
-	return len(strings.Fields(text))
-}
+var influxTagEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
 
-func callAPI(
-	ctx context.Context,
-	run int,
-	client *http.Client,
-	baseURL, key, model, prompt string,
-	maxTokens int,
-	style string,
-	stream bool,
-	ch chan<- runMetrics,
-	wg *sync.WaitGroup,
-	dataDir string,
-	storeData bool,
-) {
-	defer wg.Done()
+// influxLine renders a run in InfluxDB line protocol, timestamped at the
+// moment the request was sent.
+func influxLine(m runMetrics, style string) string {
+	return fmt.Sprintf("llmbench,model=%s,style=%s,stream=%t run=%di,prompt_tokens=%di,completion_tokens=%di,total_tokens=%di,latency_ms=%g,tok_per_sec=%g,completion_tok_per_sec=%g,total_tok_per_sec=%g,ttft_ms=%g,prefill_ms=%g,decode_ms=%g %d\n",
+		influxTagEscaper.Replace(m.Model), influxTagEscaper.Replace(style), m.Stream,
+		m.Run, m.PromptTokens, m.CompletionTokens, m.TotalTokens,
+		m.LatencyMs, m.TokPerSec, m.CompletionTokPerSec, m.TotalTokPerSec, m.TTFTMs, m.PrefillMs, m.DecodeMs,
+		m.StartedAt.UnixNano())
+}
 
-	var endpoint string
-	var body []byte
+// jsonlWriter appends runs to a --jsonl file as one JSON object per line,
+// flushing after each so the file can be tailed or loaded mid-benchmark.
+type jsonlWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
 
-	switch style {
-	case "ollama":
-		endpoint = strings.TrimRight(baseURL, "/") + "/chat"
-		body, _ = json.Marshal(map[string]any{
-			"model":    model,
-			"messages": []map[string]string{{"role": "user", "content": prompt}},
-			"stream":   stream,
-		})
-	default:
-		endpoint = strings.TrimRight(baseURL, "/") + "/chat/completions"
-		body, _ = json.Marshal(map[string]any{
-			"model":       model,
-			"messages":    []map[string]string{{"role": "user", "content": prompt}},
-			"temperature": 0.7,
-			"max_tokens":  maxTokens,
-			"stream":      stream,
-		})
+func (j *jsonlWriter) write(m runMetrics) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
 	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Write(line)
+	j.w.WriteByte('\n')
+	return j.w.Flush()
+}
 
-	req, _ := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	if style != "ollama" {
-		req.Header.Set("Authorization", "Bearer "+key)
+// usefulRun reports whether a successful run delivered something a user
+// could use, which is what goodput counts.
+func usefulRun(m runMetrics) bool {
+	return m.CompletionTokens > 0
+}
+
+// remainingDeadline returns how long a request about to be sent has left:
+// the context deadline if there is one, capped by the client timeout, which
+// starts counting at send time. It reports false when neither is set.
+func remainingDeadline(ctx context.Context, timeout time.Duration) (time.Duration, bool) {
+	var remaining time.Duration
+	dl, ok := ctx.Deadline()
+	if ok {
+		remaining = time.Until(dl)
+	}
+	if timeout > 0 && (!ok || timeout < remaining) {
+		remaining, ok = timeout, true
 	}
+	return max(remaining, 0), ok
+}
 
-	promptTokens := countTokens(prompt)
-	logEvent(run, "request", logFields{"model": model, "stream": stream, "prompt_tokens": promptTokens})
+var (
+	errStreamTimeout = errors.New("stream exceeded --timeout")
+	errStreamIdle    = errors.New("no stream data within --stream-idle-timeout")
+)
 
-	start := time.Now()
-	resp, err := client.Do(req)
-	if err != nil {
-		logEvent(run, "error", logFields{"type": "transport", "error": err.Error()})
-		return
+// streamWatchdog enforces --timeout and --stream-idle-timeout on a streamed
+// request, which can't use the client timeout without cutting off every
+// stream at the same point. It cancels the request's context with
+// errStreamTimeout or errStreamIdle as the cause. A nil watchdog does
+// nothing.
+type streamWatchdog struct {
+	total    *time.Timer
+	idle     *time.Timer
+	idleTime time.Duration
+}
+
+func newStreamWatchdog(cancel context.CancelCauseFunc, timeout, idle time.Duration) *streamWatchdog {
+	if timeout <= 0 && idle <= 0 {
+		return nil
 	}
-	elapsed := time.Since(start)
-	defer resp.Body.Close()
+	w := &streamWatchdog{idleTime: idle}
+	if timeout > 0 {
+		w.total = time.AfterFunc(timeout, func() { cancel(errStreamTimeout) })
+	}
+	if idle > 0 {
+		w.idle = time.AfterFunc(idle, func() { cancel(errStreamIdle) })
+	}
+	return w
+}
 
-	if resp.StatusCode != http.StatusOK {
-		raw, _ := io.ReadAll(resp.Body)
-		logEvent(run, "error", logFields{"type": "http", "status_code": resp.StatusCode, "response": strings.TrimSpace(string(raw))})
-		return
+// activity restarts the idle timer when data arrives.
+func (w *streamWatchdog) activity() {
+	if w != nil && w.idle != nil {
+		w.idle.Reset(w.idleTime)
 	}
+}
 
-	if stream {
-		reader := bufio.NewReader(resp.Body)
-		logEvent(run, "stream-start", logFields{"model": model})
+func (w *streamWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	if w.total != nil {
+		w.total.Stop()
+	}
+	if w.idle != nil {
+		w.idle.Stop()
+	}
+}
 
-		var contentBuilder strings.Builder
+// streamTimeoutCause returns errStreamTimeout or errStreamIdle when the
+// watchdog is what cancelled ctx, and nil otherwise.
+func streamTimeoutCause(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause == errStreamTimeout || cause == errStreamIdle {
+		return cause
+	}
+	return nil
+}
 
-		type ollamaMeta struct {
-			Model              string `json:"model"`
-			CreatedAt          string `json:"created_at"`
-			DoneReason         string `json:"done_reason"`
-			TotalDuration      int64  `json:"total_duration"`
-			LoadDuration       int64  `json:"load_duration"`
-			PromptEvalCount    int    `json:"prompt_eval_count"`
-			PromptEvalDuration int64  `json:"prompt_eval_duration"`
-			EvalCount          int    `json:"eval_count"`
-			EvalDuration       int64  `json:"eval_duration"`
-		}
-		var meta ollamaMeta
+// connTrace records how the connection carrying a request was obtained.
+// Dials can finish on another goroutine after the request has moved on to
+// an idle connection, hence the mutex.
+type connTrace struct {
+	mu           sync.Mutex
+	reused       bool
+	connectStart time.Time
+	connect      time.Duration
+}
 
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				break
-			}
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
+func (t *connTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			if err == nil && !t.connectStart.IsZero() {
+				t.connect = time.Since(t.connectStart)
 			}
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+	}
+}
 
-			// OpenAI streams are sent via Server-Sent Events prefixed with "data: ".
-			// Strip the prefix so we only keep the raw JSON payload.
-			if strings.HasPrefix(line, "data: ") {
-				line = strings.TrimPrefix(line, "data: ")
-			}
+// result reports whether the connection was reused and, for new ones, the
+// TCP connect time in milliseconds (roughly one round trip to the server).
+func (t *connTrace) result() (bool, float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reused {
+		return true, 0
+	}
+	return false, t.connect.Seconds() * 1e3
+}
 
-			// OpenAI terminates the stream with a single "[DONE]" message.
-			if line == "[DONE]" {
-				break
-			}
+// csvHeader names the --csv columns; ttft_ms is only there for streams and
+// turn only for multi-turn sessions.
+func csvHeader(stream, multiTurn bool) []string {
+	h := []string{"run", "model", "stream", "prompt_tokens", "completion_tokens", "total_tokens", "latency_ms", "tok_per_sec"}
+	if stream {
+		h = append(h, "ttft_ms")
+	}
+	if multiTurn {
+		h = append(h, "turn")
+	}
+	return h
+}
 
-			if style == "ollama" && strings.Contains(line, "\"done_reason\"") {
-				_ = json.Unmarshal([]byte(line), &meta)
-				break
-			}
+func csvRecord(m runMetrics, multiTurn bool) []string {
+	r := []string{
+		strconv.Itoa(m.Run), m.Model, strconv.FormatBool(m.Stream),
+		strconv.Itoa(m.PromptTokens), strconv.Itoa(m.CompletionTokens), strconv.Itoa(m.TotalTokens),
+		strconv.FormatFloat(m.LatencyMs, 'f', 3, 64), strconv.FormatFloat(m.TokPerSec, 'f', 3, 64),
+	}
+	if m.Stream {
+		r = append(r, strconv.FormatFloat(m.TTFTMs, 'f', 3, 64))
+	}
+	if multiTurn {
+		r = append(r, strconv.Itoa(m.Turn))
+	}
+	return r
+}
 
-			var chunk map[string]any
-			if err := json.Unmarshal([]byte(line), &chunk); err == nil {
-				if style == "ollama" {
-					// Ollama format: { "message": { "content": "..." } }
-					if msg, ok := chunk["message"].(map[string]any); ok {
-						if cstr, ok2 := msg["content"].(string); ok2 {
-							contentBuilder.WriteString(cstr)
-							if storeData {
-								err, _ := storeRunData(dataDir, run, "response", contentBuilder.String())
-								if err != nil {
-									logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-								}
-							}
-						}
-					}
-				} else {
-					// OpenAI format: { "choices": [ { "delta": { "content": "..." }, "finish_reason": null } ] }
-					if choices, ok := chunk["choices"].([]any); ok && len(choices) > 0 {
-						if choice, okChoice := choices[0].(map[string]any); okChoice {
-							if delta, okDelta := choice["delta"].(map[string]any); okDelta {
-								if cstr, okStr := delta["content"].(string); okStr {
-									contentBuilder.WriteString(cstr)
-									if storeData {
-										err, _ := storeRunData(dataDir, run, "response", contentBuilder.String())
-										if err != nil {
-											logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-										}
-									}
-								}
-							}
-
-							// If OpenAI signals the end of the stream via finish_reason, exit the loop.
-							if fr, okFinish := choice["finish_reason"].(string); okFinish && fr != "" && fr != "null" {
-								break
-							}
-						}
-					}
-				}
+// rateLimitHeaders are checked in order for the remaining request quota.
+var rateLimitHeaders = []string{
+	"x-ratelimit-remaining-requests",
+	"x-ratelimit-remaining-tokens",
+	"x-ratelimit-remaining",
+	"ratelimit-remaining",
+}
+
+// rateLimitRemaining returns the quota reported by the first rate-limit
+// header present on the response, or nil when there is none.
+func rateLimitRemaining(h http.Header) *int {
+	for _, name := range rateLimitHeaders {
+		if v := h.Get(name); v != "" {
+			if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				return &n
 			}
 		}
+	}
+	return nil
+}
 
-		elapsedStream := time.Since(start)
+// serverTimeHeaders are tried in order when --server-time-header is unset.
+var serverTimeHeaders = []string{
+	"openai-processing-ms",
+	"x-processing-time",
+	"x-processing-time-ms",
+	"x-response-time",
+	"server-timing",
+}
 
-		pTok := promptTokens
-		if style == "ollama" {
-			pTok = meta.PromptEvalCount
+// serverTimeMs returns the server-side processing time reported on the
+// response in milliseconds, or 0 if there is none. Values may be plain
+// milliseconds ("123.4"), Go durations ("120ms", "1.2s") or a Server-Timing
+// entry ("inference;dur=123.4"). With name empty the common header names
+// are tried in order.
+func serverTimeMs(h http.Header, name string) float64 {
+	names := serverTimeHeaders
+	if name != "" {
+		names = []string{name}
+	}
+	for _, name := range names {
+		v := strings.TrimSpace(h.Get(name))
+		if v == "" {
+			continue
 		}
-
-		runMetrics := runMetrics{
-			Run:              run,
-			Model:            model,
-			Stream:           stream,
-			PromptTokens:     pTok,
-			CompletionTokens: countTokens(contentBuilder.String()),
-			TotalTokens:      countTokens(contentBuilder.String()),
-			LatencyMs:        elapsedStream.Seconds() * 1e3,
-			TokPerSec:        float64(countTokens(contentBuilder.String())) / elapsedStream.Seconds(),
+		if i := strings.Index(v, "dur="); i >= 0 {
+			v = v[i+len("dur="):]
+			if j := strings.IndexAny(v, ";,"); j >= 0 {
+				v = v[:j]
+			}
 		}
+		if ms, err := strconv.ParseFloat(v, 64); err == nil {
+			return ms
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return d.Seconds() * 1e3
+		}
+	}
+	return 0
+}
 
-		logEvent(run, "success", runMetrics.ToMap())
+// redact hides a secret while still showing whether one was provided.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
 
-		ch <- runMetrics
+// redactKey removes the API key from a message before it is logged: transport
+// errors quote the URL (Gemini's carries the key) and some servers echo the
+// key back in their error bodies.
+func redactKey(msg, key string) string {
+	if key == "" {
+		return msg
+	}
+	msg = strings.ReplaceAll(msg, key, redact(key))
+	return strings.ReplaceAll(msg, url.QueryEscape(key), redact(key))
+}
 
-		if storeData {
-			err, filename := storeRunData(dataDir, run, "response", contentBuilder.String())
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-			}
-			logEvent(run, "response-stored", logFields{"file": filename})
-			data, err := json.Marshal(runMetrics)
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "json_marshal", "error": err.Error()})
-			}
-			err, filename = storeRunData(dataDir, run, "metrics", string(data))
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-			}
-			logEvent(run, "metrics-stored", logFields{"file": filename})
-		}
+// loadAPIKey resolves the key from --key-file, which takes precedence, or
+// from --key, where "@-" reads it from stdin. Either way trailing whitespace
+// and newlines are trimmed, so keys saved by editors or echo work as is.
+func loadAPIKey(key, path string) (string, error) {
+	var data []byte
+	var err error
+	switch {
+	case path != "":
+		data, err = os.ReadFile(path)
+	case key == "@-":
+		data, err = io.ReadAll(os.Stdin)
+	default:
+		return key, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading API key: %w", err)
+	}
+	key = strings.TrimRight(string(data), " \t\r\n")
+	if key == "" {
+		return "", errors.New("error reading API key: the key is empty")
+	}
+	return key, nil
+}
 
-		return
+// lineReader splits a streamed body into lines. ReadString alone already
+// joins a line split across reads, but on EOF it returns the residue after
+// the last newline together with the error, and a last chunk the server
+// didn't terminate would be dropped; lineReader hands out the residue as a
+// final line and reports the error on the next call.
+type lineReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (l *lineReader) next() (string, error) {
+	if l.err != nil {
+		return "", l.err
+	}
+	line, err := l.r.ReadString('\n')
+	if err != nil {
+		l.err = err
+		if line != "" {
+			return line, nil
+		}
 	}
+	return line, err
+}
 
-	raw, _ := io.ReadAll(resp.Body)
-	if i := bytes.IndexByte(raw, '{'); i >= 0 {
-		raw = raw[i:]
+// sseData returns the payload of an SSE line. "data:" fields lose their
+// prefix (the space after the colon is optional), other fields such as
+// event:, id: and retry: and ":" comments are reported as not data. Lines
+// that aren't SSE at all, like Ollama's NDJSON, are returned unchanged.
+func sseData(line string) (string, bool) {
+	if rest, ok := strings.CutPrefix(line, "data:"); ok {
+		return strings.TrimPrefix(rest, " "), true
 	}
+	if strings.HasPrefix(line, ":") {
+		return "", false
+	}
+	for _, field := range []string{"event:", "id:", "retry:"} {
+		if strings.HasPrefix(line, field) {
+			return "", false
+		}
+	}
+	return line, true
+}
 
-	var metrics runMetrics
+// streamToolCall is a tool call assembled from a streamed response.
+type streamToolCall struct {
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
 
-	if style == "ollama" {
-		var or ollamaResp
-		if err := json.Unmarshal(raw, &or); err != nil {
-			logEvent(run, "error", logFields{"type": "json_parse", "error": err.Error()})
-			return
+// appendToolCallDeltas merges OpenAI delta.tool_calls fragments into calls.
+// The first fragment of a call carries its id and name, later ones only
+// extend the arguments; fragments are matched up by index. It reports
+// whether any fragment carried new text.
+func appendToolCallDeltas(calls []streamToolCall, deltas []any) ([]streamToolCall, bool) {
+	var grew bool
+	for _, d := range deltas {
+		frag, ok := d.(map[string]any)
+		if !ok {
+			continue
 		}
-
-		metrics = runMetrics{
-			Run:              run,
-			Model:            model,
-			Stream:           stream,
-			PromptTokens:     promptTokens,
-			CompletionTokens: countTokens(or.Message.Content),
-			TotalTokens:      countTokens(or.Message.Content),
-			LatencyMs:        elapsed.Seconds() * 1e3,
-			TokPerSec:        float64(countTokens(or.Message.Content)) / elapsed.Seconds(),
-		}
-		logEvent(run, "success", metrics.ToMap())
-		if storeData {
-			err, filename := storeRunData(dataDir, run, "response", or.Message.Content)
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-			}
-			logEvent(run, "response-stored", logFields{"file": filename})
-			data, err := json.Marshal(metrics)
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "json_marshal", "error": err.Error()})
-			}
-			err, filename = storeRunData(dataDir, run, "metrics", string(data))
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-			}
-			logEvent(run, "metrics-stored", logFields{"file": filename})
+		idx := len(calls)
+		if f, ok := frag["index"].(float64); ok {
+			idx = int(f)
 		}
-	} else {
-		var ok successResp
-		if err := json.Unmarshal(raw, &ok); err != nil {
-			var apiErr errorResp
-			if json.Unmarshal(raw, &apiErr) == nil && apiErr.Error != "" {
-				logEvent(run, "error", logFields{"type": "api", "error": apiErr.Error})
-			} else {
-				logEvent(run, "error", logFields{"type": "json_parse", "error": err.Error()})
-			}
-			return
+		if idx < 0 {
+			continue
 		}
-		metrics = runMetrics{
-			Run:              run,
-			Model:            model,
-			Stream:           stream,
-			PromptTokens:     promptTokens,
-			CompletionTokens: ok.Usage.CompletionTokens,
-			TotalTokens:      ok.Usage.TotalTokens,
-			LatencyMs:        elapsed.Seconds() * 1e3,
-			TokPerSec:        float64(ok.Usage.TotalTokens) / elapsed.Seconds(),
-		}
-		logEvent(run, "success", metrics.ToMap())
-		if storeData {
-			err, filename := storeRunData(dataDir, run, "response", ok.Choices[0].Message.Content)
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
-			}
-			logEvent(run, "response-stored", logFields{"file": filename})
-			data, err := json.Marshal(metrics)
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "json_marshal", "error": err.Error()})
+		for len(calls) <= idx {
+			calls = append(calls, streamToolCall{})
+		}
+		tc := &calls[idx]
+		if id, ok := frag["id"].(string); ok && id != "" {
+			tc.ID = id
+		}
+		if typ, ok := frag["type"].(string); ok && typ != "" {
+			tc.Type = typ
+		}
+		if fn, ok := frag["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				tc.Name += name
+				grew = true
 			}
-			err, filename = storeRunData(dataDir, run, "metrics", string(data))
-			if err != nil {
-				logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
+			if args, ok := fn["arguments"].(string); ok && args != "" {
+				tc.Arguments += args
+				grew = true
 			}
-			logEvent(run, "metrics-stored", logFields{"file": filename})
 		}
 	}
+	return calls, grew
+}
 
-	ch <- metrics
+// appendOllamaToolCalls adds the complete tool calls from an Ollama message.
+func appendOllamaToolCalls(calls []streamToolCall, raw []any) []streamToolCall {
+	for _, r := range raw {
+		call, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		fn, _ := call["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		args, _ := json.Marshal(fn["arguments"])
+		calls = append(calls, streamToolCall{Type: "function", Name: name, Arguments: string(args)})
+	}
+	return calls
 }
 
-func main() {
-	app := &cli.App{
-		Name:  "llmbench",
-		Usage: "tiny load-tester for OpenAI & Ollama like chat APIs",
-		Flags: []cli.Flag{
-			&cli.StringFlag{Name: "base-url", Value: "https://api.openai.com/v1", Usage: "API base URL"},
-			&cli.StringFlag{Name: "key", EnvVars: []string{"LLM_API_KEY"}, Usage: "Bearer token (not used by Ollama)"},
-			&cli.StringFlag{Name: "style", Value: "openai", Usage: "API style: openai or ollama"},
-			&cli.BoolFlag{Name: "stream", Usage: "enable streaming (SSE) mode"},
-			&cli.IntFlag{Name: "runs", Value: 100, Usage: "total requests to send"},
-			&cli.IntFlag{Name: "concurrency", Value: 0, Usage: "simultaneous requests (0 = runs)"},
-			&cli.IntFlag{Name: "max-tokens", Value: 4096, Usage: "max_tokens per request (OpenAI only)"},
-			&cli.StringFlag{Name: "model", Value: "gpt-4o-mini", Usage: "model ID"},
-			&cli.StringFlag{Name: "prompt", Value: "Explain the fundamental concepts of relativity in detail.", Usage: "user message"},
-			&cli.DurationFlag{Name: "timeout", Value: 60 * time.Second, Usage: "HTTP timeout (ignored in streaming)"},
-			&cli.BoolFlag{Name: "unload-model", Value: false, Usage: "unload model after all runs complete (Ollama only)"},
-			&cli.StringFlag{Name: "data-dir", Value: "./runs", Usage: "directory to save data files"},
-			&cli.BoolFlag{Name: "store-data", Value: false, Usage: "store data files (responses, metrics)"},
-		},
-		Action: func(c *cli.Context) error {
-			start := time.Now()
+// toolCallText joins the generated parts of the tool calls for token counting.
+func toolCallText(calls []streamToolCall) string {
+	var sb strings.Builder
+	for _, tc := range calls {
+		sb.WriteString(" ")
+		sb.WriteString(tc.Name)
+		sb.WriteString(" ")
+		sb.WriteString(tc.Arguments)
+	}
+	return sb.String()
+}
 
-			style := strings.ToLower(c.String("style"))
+// benchConfig holds the settings shared by every run of a benchmark.
+type benchConfig struct {
+	Client        *http.Client
+	GRPC          *grpcClient
+	BaseURL       string
+	Key           string
+	Model         string
+	Models        []string // every --model; runs rotate through them
+	Prompt        string
+	System        string // system prompt; empty sends none
+	Dataset       *promptDataset
+	Style         string
+	Endpoint      string // OpenAI style: "chat" or "completions"
+	Stream        bool
+	DryRun        bool // print the request instead of sending it
+	MaxTokens     int
+	MaxTokensDist *tokenDist
+	ExpectStatus  int
+	TPSMode       string
+	DataDir       string
+	StoreData     bool
+	Retries       int
+	RetryBackoff  time.Duration // first retry delay, doubled per attempt
+	RetryBudget   *retryBudget
 
-			dataDir := c.String("data-dir")
-			storeData := c.Bool("store-data")
-			if storeData && dataDir == "" {
-				return cli.Exit("data-dir must be set when store-data is enabled", 1)
-			}
+	// MaxTokensField overrides the name of the OpenAI chat limit
+	// (--use-max-completion-tokens); empty sends max_tokens.
+	MaxTokensField string
 
-			apiKey := c.String("key")
-			if style != "ollama" && apiKey == "" {
-				return cli.Exit("missing API key (use --key or set LLM_API_KEY)", 1)
-			}
+	// ExpectContains and MinCompletion (in completion tokens) fail runs
+	// whose reply lacks the substring or is shorter; empty and zero check
+	// nothing.
+	ExpectContains string
+	MinCompletion  int
 
-			runs := c.Int("runs")
-			conc := c.Int("concurrency")
-			if conc <= 0 || conc > runs {
-				conc = runs
-			}
+	// ThinkTags is "count" to estimate reasoning tokens from <think> blocks
+	// when the usage doesn't report them, "strip" to also drop the blocks
+	// from the reply, or empty to leave replies alone.
+	ThinkTags string
 
-			var client *http.Client
-			if c.Bool("stream") {
-				client = &http.Client{Timeout: 0}
-			} else {
-				client = &http.Client{Timeout: c.Duration("timeout")}
-			}
-
-			results := make(chan runMetrics, runs)
-			var wg sync.WaitGroup
-			sem := make(chan struct{}, conc)
-
-			for i := 1; i <= runs; i++ {
-				wg.Add(1)
-				sem <- struct{}{}
-				go func(run int) {
-					defer func() { <-sem }()
-					callAPI(
-						c.Context,
-						run, client,
-						c.String("base-url"), apiKey,
-						c.String("model"), c.String("prompt"),
-						c.Int("max-tokens"),
-						style,
-						c.Bool("stream"),
-						results, &wg,
-						dataDir, storeData,
-					)
-				}(i)
-			}
-
-			go func() {
-				wg.Wait()
-				close(results)
-			}()
+	// StreamTimeout caps a whole streamed request and StreamIdleTimeout
+	// the wait for its next chunk; zero disables either.
+	StreamTimeout     time.Duration
+	StreamIdleTimeout time.Duration
 
-			var sumC, sumT int
-			var sumTPS float64
-			var good int
-			var totalElapsed time.Duration
-			for m := range results {
-				sumC += m.CompletionTokens
-				sumT += m.TotalTokens
-				sumTPS += m.TokPerSec
-				totalElapsed += time.Duration(m.LatencyMs) * time.Millisecond
-				good++
-			}
+	// RPS, when positive, paces dispatch to this many runs per second
+	// regardless of how many are in flight.
+	RPS float64
 
-			fmt.Printf("\n=== Summary ===\n")
-			fmt.Printf("Successful calls         : %d / %d\n", good, runs)
-			if good > 0 {
-				fmt.Printf("Avg completion tokens    : %.2f\n", float64(sumC)/float64(good))
-				fmt.Printf("Avg total tokens         : %.2f\n", float64(sumT)/float64(good))
-				fmt.Printf("Avg tokens / sec         : %.2f\n", sumTPS/float64(good))
-				fmt.Printf("Total completion tokens  : %d\n", sumC)
-				fmt.Printf("Total tokens             : %d\n", sumT)
-			}
+	// Duration, when non-zero, replaces the run count: requests are
+	// dispatched until it has passed.
+	Duration time.Duration
 
-			if style == "ollama" && c.Bool("unload-model") {
-				endpoint := strings.TrimRight(c.String("base-url"), "/") + "/chat"
-				body, _ := json.Marshal(map[string]any{
-					"model":      c.String("model"),
-					"keep_alive": 0,
-				})
-				req, _ := http.NewRequestWithContext(c.Context, "POST", endpoint, bytes.NewReader(body))
-				req.Header.Set("Content-Type", "application/json")
-				resp, err := client.Do(req)
-				if err != nil {
-					return fmt.Errorf("error unloading model: %w", err)
-				}
-				defer resp.Body.Close()
-				if resp.StatusCode != http.StatusOK {
-					raw, _ := io.ReadAll(resp.Body)
-					return fmt.Errorf("error unloading model: %s (status code %d)", strings.TrimSpace(string(raw)), resp.StatusCode)
-				}
-			}
-			fmt.Printf("Total elapsed time       : %s\n", totalElapsed)
-			fmt.Printf("Total time taken         : %s\n", time.Duration(time.Since(start)).Round(time.Millisecond))
+	// Ramp, when set, raises the concurrency limit over time up to the
+	// concurrency the benchmark is run with.
+	Ramp *rampSchedule
 
-			return nil
-		},
+	// Turns is the number of requests each virtual user sends in sequence,
+	// each carrying the conversation so far; FollowUp is the user message
+	// for every turn after the first and ThinkTime the pause before it.
+	Turns     int
+	FollowUp  string
+	ThinkTime thinkTime
+
+	// Tools is a JSON array of tool definitions sent with every request,
+	// or nil to send none.
+	Tools json.RawMessage
+
+	// Custom is the request template and response paths of --style custom.
+	Custom *customStyle
+
+	// Sampling holds the OpenAI sampling fields (temperature, top_p and
+	// the penalties). Params are the --param fields, merged into every
+	// request body last (see mergeParams) so they override anything else.
+	Sampling map[string]any
+	Params   map[string]any
+
+	// ServerTimeHeader names the response header carrying server-side
+	// processing time; empty means try the common ones.
+	ServerTimeHeader string
+
+	// DeadlineHeader, when set, names the request header that carries the
+	// time the request has left in milliseconds.
+	DeadlineHeader string
+
+	// FairnessInterval is how often concurrent streams are sampled for
+	// the fairness score.
+	FairnessInterval time.Duration
+
+	// Headers are the --header values, set on every request after the
+	// built-in ones so they can override them.
+	Headers http.Header
+
+	// Pricing, when set, prices every run as cost_usd.
+	Pricing *pricing
+
+	// Errors, when set, counts failed requests by category.
+	Errors *errorTracker
+
+	// TimeseriesDir, when set, receives each stream's per-chunk token curve.
+	TimeseriesDir string
+
+	// Statuses, when set, counts HTTP responses by status code.
+	Statuses *statusTracker
+
+	// Progress, when set, shows a live status line while runs complete.
+	Progress *progress
+
+	// KeepRuns keeps every successful run in benchResult.Runs for the
+	// outputs that list or store them. Otherwise the summary works from
+	// running totals and a bounded sample, so memory stays flat however
+	// long the benchmark runs.
+	KeepRuns bool
+
+	// WaveTolerance is how close together runs must start to count as one
+	// wave in the wave spread.
+	WaveTolerance time.Duration
+
+	// Abort, when set, cancels the requests in flight. Requests otherwise
+	// outlive the context that stops dispatch, so runs already started
+	// can finish.
+	Abort context.Context
+}
+
+// prompt returns the user message for a run: the dataset entry at index,
+// or --prompt when no dataset is loaded.
+func (cfg *benchConfig) prompt(index int) string {
+	if cfg.Dataset != nil && index >= 0 {
+		return cfg.Dataset.prompts[index]
+	}
+	return cfg.Prompt
+}
+
+// openingMessages is the conversation a run starts with: the system prompt,
+// if any, and the run's prompt.
+func (cfg *benchConfig) openingMessages(promptIndex int) []chatMessage {
+	var messages []chatMessage
+	if cfg.System != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: cfg.System})
+	}
+	return append(messages, chatMessage{Role: "user", Content: cfg.prompt(promptIndex)})
+}
+
+// checkReply applies --expect-contains and --min-completion-tokens to a
+// reply the server sent successfully. A reply that fails them is logged and
+// counted under its own error category, and the run counts as failed.
+func (cfg *benchConfig) checkReply(run int, content string, m runMetrics) bool {
+	var category, message string
+	switch {
+	case cfg.ExpectContains != "" && !strings.Contains(content, cfg.ExpectContains):
+		excerpt := content
+		if r := []rune(excerpt); len(r) > 80 {
+			excerpt = string(r[:80]) + "…"
+		}
+		category, message = "assert_contains", fmt.Sprintf("reply does not contain %q: %q", cfg.ExpectContains, excerpt)
+	case m.CompletionTokens < cfg.MinCompletion:
+		category, message = "assert_min_tokens", fmt.Sprintf("%d completion tokens, want at least %d", m.CompletionTokens, cfg.MinCompletion)
+	default:
+		return true
+	}
+	logEvent(run, "error", logFields{"type": category, "error": message})
+	cfg.Errors.record(category, message)
+	return false
+}
+
+// reasoning sets m.ReasoningTokens from the usage block or, with
+// --think-tags, from the reply's <think> blocks, and returns the reply the
+// rest of the run works with: without them under --think-tags strip.
+func (cfg *benchConfig) reasoning(m *runMetrics, usage *usageBlock, content string) string {
+	if usage != nil {
+		m.ReasoningTokens = usage.CompletionTokensDetails.ReasoningTokens
+	}
+	if cfg.ThinkTags == "" {
+		return content
+	}
+	thinking, answer := splitThink(content)
+	if m.ReasoningTokens == 0 && thinking != "" {
+		m.ReasoningTokens = min(countTokens(thinking), m.CompletionTokens)
+	}
+	if cfg.ThinkTags == "strip" {
+		return strings.TrimSpace(answer)
+	}
+	return content
+}
+
+// splitThink separates the <think>...</think> blocks that reasoning models
+// such as deepseek-r1 and qwen3 put in their replies from the answer. A
+// block the reply ends inside runs to the end.
+func splitThink(content string) (thinking, answer string) {
+	var t, a strings.Builder
+	for {
+		i := strings.Index(content, "<think>")
+		if i < 0 {
+			a.WriteString(content)
+			break
+		}
+		a.WriteString(content[:i])
+		content = content[i+len("<think>"):]
+		j := strings.Index(content, "</think>")
+		if j < 0 {
+			t.WriteString(content)
+			break
+		}
+		t.WriteString(content[:j])
+		content = content[j+len("</think>"):]
+	}
+	return t.String(), a.String()
+}
+
+// datasetIndex is the prompt_index recorded for a run, nil without a
+// dataset.
+func datasetIndex(index int) *int {
+	if index < 0 {
+		return nil
+	}
+	return &index
+}
+
+// countingBody counts the bytes read from a response body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// callAPI sends one chat request carrying messages and reports its metrics
+// on ch. It returns the assistant's reply and whether the run succeeded.
+// turn is the position within a multi-turn session, or 0 outside one, and
+// promptIndex the --prompt-dataset entry being sent, or -1.
+func callAPI(
+	ctx context.Context,
+	run, turn int,
+	cfg *benchConfig,
+	maxTokens, promptIndex int,
+	messages []chatMessage,
+	ch chan<- runMetrics,
+	tracker *streamTracker,
+) (string, bool) {
+	client, key, model := cfg.Client, cfg.Key, cfg.Model
+	style, stream, expectStatus, tpsMode := cfg.Style, cfg.Stream, cfg.ExpectStatus, cfg.TPSMode
+	dataDir, storeData := cfg.DataDir, cfg.StoreData
+
+	req, err := buildRequest(style, cfg.BaseURL, key, model, messages, requestOptions{
+		MaxTokensField: cfg.MaxTokensField,
+		Endpoint:       cfg.Endpoint,
+		Stream:         stream,
+		MaxTokens:      maxTokens,
+		Tools:          cfg.Tools,
+		Sampling:       cfg.Sampling,
+		Params:         cfg.Params,
+		Headers:        cfg.Headers,
+		Custom:         cfg.Custom,
+	})
+	if err != nil {
+		logEvent(run, "error", logFields{"type": "request", "error": err.Error()})
+		cfg.Errors.record("request", err.Error())
+		return "", false
+	}
+	if cfg.DryRun {
+		writeDryRun(os.Stdout, req, key)
+		return "", true
+	}
+
+	var promptTokens int
+	for _, msg := range messages {
+		promptTokens += countTokens(msg.Content)
+	}
+	fields := logFields{"model": model, "stream": stream, "prompt_tokens": promptTokens}
+	if turn > 0 {
+		fields["turn"] = turn
+	}
+	if promptIndex >= 0 {
+		fields["prompt_index"] = promptIndex
+	}
+	logEvent(run, "request", fields)
+
+	var start time.Time
+	var resp *http.Response
+	var conn *connTrace
+	var retries int
+	// Every attempt runs under its own context, which the stream watchdog
+	// cancels; the last one lives until the response has been read.
+	var attemptCtx context.Context
+	cancelAttempt := context.CancelCauseFunc(func(error) {})
+	var watchdog *streamWatchdog
+	defer func() {
+		watchdog.stop()
+		cancelAttempt(nil)
+	}()
+	timeout := client.Timeout
+	if stream {
+		timeout = cfg.StreamTimeout
+	}
+	for ; ; retries++ {
+		watchdog.stop()
+		cancelAttempt(nil)
+		actx, cancel := context.WithCancelCause(ctx)
+		attemptCtx, cancelAttempt = actx, cancel
+		if stream {
+			watchdog = newStreamWatchdog(cancel, cfg.StreamTimeout, cfg.StreamIdleTimeout)
+		}
+
+		conn = &connTrace{}
+		traceCtx := httptrace.WithClientTrace(attemptCtx, conn.clientTrace())
+		attempt := req.Clone(traceCtx)
+		attempt.Body, _ = req.GetBody()
+		if cfg.DeadlineHeader != "" {
+			if remaining, ok := remainingDeadline(ctx, timeout); ok {
+				attempt.Header.Set(cfg.DeadlineHeader, strconv.FormatInt(remaining.Milliseconds(), 10))
+			}
+		}
+
+		start = time.Now()
+		resp, err = client.Do(attempt)
+		if err == nil {
+			cfg.Statuses.record(resp.StatusCode)
+		}
+		if !shouldRetry(resp, err, expectStatus) || retries >= cfg.Retries {
+			break
+		}
+		if !cfg.RetryBudget.take() {
+			logEvent(run, "retry-skipped", logFields{"reason": "retry_budget_exhausted", "attempt": retries + 1})
+			break
+		}
+		delay := retryDelay(resp, cfg.RetryBackoff, retries+1)
+		fields := logFields{"attempt": retries + 1, "backoff_ms": delay.Milliseconds()}
+		if err != nil {
+			fields["error"] = err.Error()
+		} else {
+			fields["status_code"] = resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logEvent(run, "retry", fields)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		// The run was given up on while waiting; another attempt would only
+		// spend the retry budget on it.
+		if ctx.Err() != nil {
+			resp, err = nil, fmt.Errorf("cancelled during retry backoff: %w", context.Cause(ctx))
+			break
+		}
+	}
+	if err != nil {
+		msg := redactKey(err.Error(), key)
+		category := transportCategory(err)
+		if cause := streamTimeoutCause(attemptCtx); cause != nil {
+			category, msg = "timeout", cause.Error()
+		} else if ctx.Err() != nil {
+			category = "cancelled"
+		}
+		logEvent(run, "error", logFields{"type": "transport", "error": msg})
+		cfg.Errors.record(category, msg)
+		return "", false
+	}
+	elapsed := time.Since(start)
+	defer resp.Body.Close()
+	connReused, connectMs := conn.result()
+	body := &countingBody{ReadCloser: resp.Body}
+	resp.Body = body
+
+	// In negative-testing mode a run passes when the server answers with the
+	// expected status, so there is no completion to parse.
+	if expectStatus != 0 && expectStatus != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		elapsed = time.Since(start)
+		if resp.StatusCode != expectStatus {
+			body := redactKey(strings.TrimSpace(string(raw)), key)
+			logEvent(run, "error", logFields{"type": "unexpected_status", "status_code": resp.StatusCode, "expected_status": expectStatus, "response": body})
+			cfg.Errors.record(fmt.Sprintf("http-%d", resp.StatusCode), fmt.Sprintf("expected status %d: %s", expectStatus, body))
+			if storeData {
+				persistError(dataDir, run, turn, resp.StatusCode, body)
+			}
+			return "", false
+		}
+		metrics := runMetrics{
+			Run:                run,
+			Turn:               turn,
+			Model:              model,
+			Stream:             stream,
+			PromptTokens:       promptTokens,
+			LatencyMs:          elapsed.Seconds() * 1e3,
+			MaxTokens:          maxTokens,
+			PromptIndex:        datasetIndex(promptIndex),
+			StatusCode:         resp.StatusCode,
+			Retries:            retries,
+			RateLimitRemaining: rateLimitRemaining(resp.Header),
+			ServerTimeMs:       serverTimeMs(resp.Header, cfg.ServerTimeHeader),
+			ConnReused:         connReused,
+			ConnectMs:          connectMs,
+			ReqBytes:           req.ContentLength,
+			RespBytes:          body.n,
+			StartedAt:          start,
+		}
+		logEvent(run, "expected-status", metrics.ToMap())
+		ch <- metrics
+		return "", true
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		body := redactKey(strings.TrimSpace(string(raw)), key)
+		logEvent(run, "error", logFields{"type": "http", "status_code": resp.StatusCode, "response": body})
+		cfg.Errors.record(fmt.Sprintf("http-%d", resp.StatusCode), body)
+		if storeData {
+			persistError(dataDir, run, turn, resp.StatusCode, body)
+		}
+		return "", false
+	}
+
+	if stream {
+		reader := &lineReader{r: bufio.NewReader(resp.Body)}
+		logEvent(run, "stream-start", logFields{"model": model})
+		tracker.start(run)
+		defer tracker.finish(run)
+
+		var contentBuilder strings.Builder
+		var toolCalls []streamToolCall
+		var firstToken time.Time
+
+		// Ollama's final line carries its server-side timings.
+		var meta ollamaResp
+		// Token counts the stream reported, merged across the lines that
+		// carry them.
+		var streamUsage *usageBlock
+		// Every chunk carrying generated text, for the inter-token latency
+		// and --timeseries-dir.
+		var chunks []streamChunk
+
+		// Lines that aren't valid JSON are skipped but counted, since each
+		// may have carried tokens the run then undercounts.
+		var malformed int
+		var malformedExample string
+
+		// A stream that breaks off, rather than ending, fails the run.
+		var readErr error
+		for {
+			// Reads on the body return once the attempt's context is done,
+			// but lines already buffered would still be served; stop at
+			// the next line instead.
+			if err := attemptCtx.Err(); err != nil {
+				readErr = err
+				break
+			}
+			line, err := reader.next()
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				break
+			}
+			watchdog.activity()
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			// OpenAI and Anthropic stream Server-Sent Events; keep only the
+			// JSON payload of "data:" fields. Ollama's NDJSON passes through.
+			line, ok := sseData(line)
+			if !ok {
+				continue
+			}
+
+			d, err := parseStreamChunk(style, line)
+			if err != nil {
+				malformed++
+				if malformedExample == "" {
+					malformedExample = line
+					if r := []rune(line); len(r) > 80 {
+						malformedExample = string(r[:80]) + "…"
+					}
+				}
+				continue
+			}
+			if d.Output {
+				if firstToken.IsZero() {
+					firstToken = time.Now()
+				}
+				chunks = append(chunks, streamChunk{at: time.Now(), offset: contentBuilder.Len()})
+				tracker.chunk(run)
+			}
+			contentBuilder.WriteString(d.Content)
+			toolCalls = d.appendToolCalls(toolCalls)
+			if d.Usage != nil {
+				streamUsage = mergeUsage(streamUsage, *d.Usage)
+			}
+			if d.Ollama != nil {
+				meta = *d.Ollama
+			}
+			if d.Done {
+				break
+			}
+		}
+
+		elapsedStream := time.Since(start)
+		if malformed > 0 {
+			logEvent(run, "stream-malformed", logFields{"lines": malformed, "example": malformedExample})
+		}
+		// Broken streams get a series too: that is where stalls show.
+		if cfg.TimeseriesDir != "" {
+			if filename, err := writeTimeseries(cfg.TimeseriesDir, run, turn, start, contentBuilder.String(), chunks); err != nil {
+				logEvent(run, "error", logFields{"type": "timeseries", "error": err.Error()})
+			} else {
+				logEvent(run, "timeseries-stored", logFields{"file": filename, "chunks": len(chunks)})
+			}
+		}
+		if readErr != nil {
+			category, msg := transportCategory(readErr), readErr.Error()
+			if cause := streamTimeoutCause(attemptCtx); cause != nil {
+				category, msg = "timeout", cause.Error()
+			} else if ctx.Err() != nil {
+				// The caller gave up on the run; the server did nothing wrong.
+				category, msg = "cancelled", fmt.Sprintf("stream cancelled: %v", context.Cause(ctx))
+			}
+			logEvent(run, "error", logFields{
+				"type":           "stream",
+				"error":          msg,
+				"elapsed_ms":     elapsedStream.Milliseconds(),
+				"chunks":         len(chunks),
+				"partial_tokens": countTokens(contentBuilder.String()),
+			})
+			cfg.Errors.record(category, msg)
+			if category == "cancelled" {
+				partial := countTokens(contentBuilder.String())
+				var ttftMs float64
+				if !firstToken.IsZero() {
+					ttftMs = firstToken.Sub(start).Seconds() * 1e3
+				}
+				ch <- runMetrics{
+					Run:              run,
+					Turn:             turn,
+					Model:            model,
+					Stream:           stream,
+					PromptTokens:     promptTokens,
+					CompletionTokens: partial,
+					TotalTokens:      promptTokens + partial,
+					TokenSource:      "estimate",
+					LatencyMs:        elapsedStream.Seconds() * 1e3,
+					TTFTMs:           ttftMs,
+					MaxTokens:        maxTokens,
+					PromptIndex:      datasetIndex(promptIndex),
+					StatusCode:       resp.StatusCode,
+					Retries:          retries,
+					ConnReused:       connReused,
+					ConnectMs:        connectMs,
+					ReqBytes:         req.ContentLength,
+					RespBytes:        body.n,
+					StartedAt:        start,
+					Cancelled:        true,
+				}
+			}
+			return "", false
+		}
+
+		pTok := promptTokens
+		if style == "ollama" {
+			pTok = meta.PromptEvalCount
+		}
+		if streamUsage != nil && streamUsage.PromptTokens > 0 {
+			pTok = streamUsage.PromptTokens
+		}
+
+		// Without server-side timings, TTFT stands in for prefill and the
+		// rest of the stream for decode. Ollama reports the real split.
+		var ttftMs, prefillMs, decodeMs float64
+		if !firstToken.IsZero() {
+			ttftMs = firstToken.Sub(start).Seconds() * 1e3
+			prefillMs = ttftMs
+			decodeMs = elapsedStream.Seconds()*1e3 - ttftMs
+		}
+		if style == "ollama" && meta.EvalDuration > 0 {
+			prefillMs = float64(meta.PromptEvalDuration) / 1e6
+			decodeMs = float64(meta.EvalDuration) / 1e6
+		}
+
+		// Tool-call names and arguments are generated tokens too; without
+		// them a tool-calling stream would report zero completion tokens.
+		completion := contentBuilder.String() + toolCallText(toolCalls)
+		completionTokens := countTokens(completion)
+		tokenSource := "estimate"
+		switch {
+		case style == "ollama" && meta.EvalCount > 0:
+			completionTokens = meta.EvalCount
+			tokenSource = "usage"
+		case streamUsage != nil && streamUsage.CompletionTokens > 0:
+			completionTokens = streamUsage.CompletionTokens
+			tokenSource = "usage"
+		}
+
+		itlMean, itlP95 := interTokenLatency(chunks)
+
+		runMetrics := runMetrics{
+			Run:                  run,
+			Turn:                 turn,
+			Model:                model,
+			Stream:               stream,
+			PromptTokens:         pTok,
+			CompletionTokens:     completionTokens,
+			TotalTokens:          pTok + completionTokens,
+			TokenSource:          tokenSource,
+			LatencyMs:            elapsedStream.Seconds() * 1e3,
+			TTFTMs:               ttftMs,
+			ITLMeanMs:            itlMean,
+			ITLP95Ms:             itlP95,
+			PrefillMs:            prefillMs,
+			DecodeMs:             decodeMs,
+			LoadDurationMs:       float64(meta.LoadDuration) / 1e6,
+			PromptEvalDurationMs: float64(meta.PromptEvalDuration) / 1e6,
+			EvalDurationMs:       float64(meta.EvalDuration) / 1e6,
+			MaxTokens:            maxTokens,
+			PromptIndex:          datasetIndex(promptIndex),
+			StatusCode:           resp.StatusCode,
+			Retries:              retries,
+			RateLimitRemaining:   rateLimitRemaining(resp.Header),
+			ServerTimeMs:         serverTimeMs(resp.Header, cfg.ServerTimeHeader),
+			ConnReused:           connReused,
+			ConnectMs:            connectMs,
+			ReqBytes:             req.ContentLength,
+			RespBytes:            body.n,
+			StartedAt:            start,
+		}
+		reply := cfg.reasoning(&runMetrics, streamUsage, contentBuilder.String())
+		runMetrics.setRates(tpsMode)
+		runMetrics.CostUSD = cfg.Pricing.cost(runMetrics)
+		if !cfg.checkReply(run, reply, runMetrics) {
+			return "", false
+		}
+
+		logEvent(run, "success", runMetrics.ToMap())
+
+		ch <- runMetrics
+
+		if storeData {
+			persistRun(dataDir, run, turn, reply, runMetrics)
+			if len(toolCalls) > 0 {
+				if data, err := json.MarshalIndent(toolCalls, "", "  "); err != nil {
+					logEvent(run, "error", logFields{"type": "json_marshal", "error": err.Error()})
+				} else if filename, err := storeRunData(dataDir, run, turnKind(turn, "tool_calls"), string(data)); err != nil {
+					logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
+				} else {
+					logEvent(run, "tool-calls-stored", logFields{"file": filename, "count": len(toolCalls)})
+				}
+			}
+		}
+
+		return reply, true
+	}
+
+	raw, _ := io.ReadAll(resp.Body)
+	var parsed apiResponse
+	if style == "custom" {
+		parsed, err = cfg.Custom.parse(raw)
+	} else {
+		parsed, err = parseResponse(style, raw)
+	}
+	if err != nil {
+		category := "json_parse"
+		var ae *apiError
+		if errors.As(err, &ae) {
+			category = "api"
+		}
+		logEvent(run, "error", logFields{"type": category, "error": err.Error()})
+		cfg.Errors.record(category, err.Error())
+		return "", false
+	}
+
+	var metrics runMetrics
+	if style == "ollama" {
+		// Ollama reports its own token counts; older servers that leave
+		// them out fall back to the estimate.
+		pTok, cTok, tokenSource := promptTokens, countTokens(parsed.Content), "estimate"
+		if parsed.Usage.CompletionTokens > 0 {
+			cTok, tokenSource = parsed.Usage.CompletionTokens, "usage"
+			if parsed.Usage.PromptTokens > 0 {
+				pTok = parsed.Usage.PromptTokens
+			}
+		}
+
+		metrics = runMetrics{
+			Run:                  run,
+			Turn:                 turn,
+			Model:                model,
+			Stream:               stream,
+			PromptTokens:         pTok,
+			CompletionTokens:     cTok,
+			TotalTokens:          pTok + cTok,
+			TokenSource:          tokenSource,
+			LatencyMs:            elapsed.Seconds() * 1e3,
+			PrefillMs:            float64(parsed.PromptEvalDuration) / 1e6,
+			DecodeMs:             float64(parsed.EvalDuration) / 1e6,
+			LoadDurationMs:       float64(parsed.LoadDuration) / 1e6,
+			PromptEvalDurationMs: float64(parsed.PromptEvalDuration) / 1e6,
+			EvalDurationMs:       float64(parsed.EvalDuration) / 1e6,
+			MaxTokens:            maxTokens,
+			PromptIndex:          datasetIndex(promptIndex),
+			StatusCode:           resp.StatusCode,
+			Retries:              retries,
+			RateLimitRemaining:   rateLimitRemaining(resp.Header),
+			ServerTimeMs:         serverTimeMs(resp.Header, cfg.ServerTimeHeader),
+			ConnReused:           connReused,
+			ConnectMs:            connectMs,
+			ReqBytes:             req.ContentLength,
+			RespBytes:            body.n,
+			StartedAt:            start,
+		}
+	} else {
+		usage := parsed.Usage
+		if usage.PromptTokens > 0 {
+			promptTokens = usage.PromptTokens
+		}
+
+		// Plenty of OpenAI-compatible servers leave out the usage block,
+		// which would otherwise show up as zero tokens and zero tok/sec.
+		tokenSource := "usage"
+		if usage.CompletionTokens == 0 && usage.TotalTokens == 0 {
+			tokenSource = "estimate"
+			usage.CompletionTokens = countTokens(parsed.Content)
+			logEvent(run, "usage-missing", logFields{"completion_tokens": usage.CompletionTokens, "source": "estimate"})
+		}
+
+		metrics = runMetrics{
+			Run:                run,
+			Turn:               turn,
+			Model:              model,
+			Stream:             stream,
+			PromptTokens:       promptTokens,
+			CompletionTokens:   usage.CompletionTokens,
+			TotalTokens:        promptTokens + usage.CompletionTokens,
+			TokenSource:        tokenSource,
+			LatencyMs:          elapsed.Seconds() * 1e3,
+			MaxTokens:          maxTokens,
+			PromptIndex:        datasetIndex(promptIndex),
+			StatusCode:         resp.StatusCode,
+			Retries:            retries,
+			RateLimitRemaining: rateLimitRemaining(resp.Header),
+			ServerTimeMs:       serverTimeMs(resp.Header, cfg.ServerTimeHeader),
+			ConnReused:         connReused,
+			ConnectMs:          connectMs,
+			ReqBytes:           req.ContentLength,
+			RespBytes:          body.n,
+			StartedAt:          start,
+		}
+	}
+	reply := cfg.reasoning(&metrics, &parsed.Usage, parsed.Content)
+	metrics.setRates(tpsMode)
+	metrics.CostUSD = cfg.Pricing.cost(metrics)
+	if !cfg.checkReply(run, reply, metrics) {
+		return "", false
+	}
+	logEvent(run, "success", metrics.ToMap())
+	if storeData {
+		persistRun(dataDir, run, turn, reply, metrics)
+		// The response file holds the extracted reply; keep the body it
+		// came from for anything the extraction leaves out.
+		if filename, err := storeRunData(dataDir, run, turnKind(turn, "raw"), string(raw)); err != nil {
+			logEvent(run, "error", logFields{"type": "store_data", "error": err.Error()})
+		} else {
+			logEvent(run, "raw-stored", logFields{"file": filename})
+		}
+	}
+
+	ch <- metrics
+	return reply, true
+}
+
+// writeDryRun prints a request the way --dry-run shows it: method and URL,
+// headers, then the pretty-printed body. The API key is redacted wherever
+// the style puts it.
+func writeDryRun(w io.Writer, req *http.Request, key string) {
+	target := req.URL.String()
+	if key != "" {
+		target = strings.ReplaceAll(target, "key="+url.QueryEscape(key), "key="+redact(key))
+	}
+	fmt.Fprintf(w, "%s %s\n", req.Method, target)
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			switch name {
+			case "Authorization":
+				scheme, _, _ := strings.Cut(value, " ")
+				value = scheme + " " + redact(key)
+			case "X-Api-Key":
+				value = redact(value)
+			}
+			fmt.Fprintf(w, "%s: %s\n", name, value)
+		}
+	}
+	rc, _ := req.GetBody()
+	body, _ := io.ReadAll(rc)
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil {
+		pretty.Write(body)
+	}
+	fmt.Fprintf(w, "\n%s\n", pretty.String())
+}
+
+// anthropicVersion is the Messages API version sent with every request.
+const anthropicVersion = "2023-06-01"
+
+// setAuthHeaders authenticates req the way the style expects: a bearer
+// token for OpenAI style APIs and custom ones given a key, x-api-key for
+// Anthropic and nothing for Ollama, Gemini, whose key goes in the URL, or
+// Bedrock, whose requests are signed by the transport.
+func setAuthHeaders(req *http.Request, style, key string) {
+	switch style {
+	case "ollama", "gemini", "bedrock":
+	case "custom":
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+	case "anthropic":
+		req.Header.Set("x-api-key", key)
+		req.Header.Set("anthropic-version", anthropicVersion)
+	default:
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// describePool summarizes the connection pool settings that shape results
+// at high concurrency, so runs with different settings aren't compared
+// unknowingly.
+func describePool(t *http.Transport) string {
+	if t.DisableKeepAlives {
+		return "keep-alive disabled (new connection per request)"
+	}
+	perHost := t.MaxIdleConnsPerHost
+	if perHost == 0 {
+		perHost = http.DefaultMaxIdleConnsPerHost
+	}
+	idle, limit := "unlimited", "unlimited"
+	if t.MaxIdleConns > 0 {
+		idle = strconv.Itoa(t.MaxIdleConns)
+	}
+	if t.MaxConnsPerHost > 0 {
+		limit = strconv.Itoa(t.MaxConnsPerHost)
+	}
+	return fmt.Sprintf("keep-alive, max %s idle (%d per host), max %s per host", idle, perHost, limit)
+}
+
+// loadTLSConfig builds the client TLS settings for --insecure-skip-verify
+// and --cacert, or returns nil to keep Go's defaults.
+func loadTLSConfig(insecure bool, caFile string) (*tls.Config, error) {
+	if !insecure && caFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// parseHeaders validates repeated --header "Name: Value" flags.
+func parseHeaders(specs []string) (http.Header, error) {
+	h := http.Header{}
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q (expected \"Name: Value\")", spec)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+// setExtraHeaders applies the --header values, replacing any header of the
+// same name already on req.
+func setExtraHeaders(req *http.Request, headers http.Header) {
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+}
+
+// fetchModels lists the model IDs served by the endpoint, using /models for
+// OpenAI style APIs and Gemini and /tags for Ollama.
+func fetchModels(ctx context.Context, client *http.Client, baseURL, key, style string, headers http.Header) ([]string, error) {
+	endpoint := strings.TrimRight(baseURL, "/") + "/models"
+	switch style {
+	case "ollama":
+		endpoint = strings.TrimRight(baseURL, "/") + "/tags"
+	case "gemini":
+		endpoint += "?" + url.Values{"key": {key}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		setAuthHeaders(req, style, key)
+	}
+	setExtraHeaders(req, headers)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s (status code %d)", strings.TrimSpace(string(raw)), resp.StatusCode)
+	}
+
+	var mr modelsResp
+	if err := json.Unmarshal(raw, &mr); err != nil {
+		return nil, fmt.Errorf("error parsing model list: %w", err)
+	}
+	ids := make([]string, 0, len(mr.Data)+len(mr.Models))
+	for _, m := range mr.Data {
+		ids = append(ids, m.ID)
+	}
+	for _, m := range mr.Models {
+		// Gemini names its models "models/<id>".
+		ids = append(ids, strings.TrimPrefix(m.Name, "models/"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// hasModel reports whether model is in ids, treating Ollama's implicit
+// ":latest" tag as equivalent to the bare name.
+func hasModel(ids []string, model string) bool {
+	for _, id := range ids {
+		if id == model || id == model+":latest" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMeasureWindow parses a window such as "20%-80%" into fractions of the
+// benchmark wall-clock.
+func parseMeasureWindow(s string) (float64, float64, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid measure-window %q (expected e.g. 20%%-80%%)", s)
+	}
+	lo, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(from), "%"), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid measure-window %q: %w", s, err)
+	}
+	hi, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(to), "%"), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid measure-window %q: %w", s, err)
+	}
+	if lo < 0 || hi > 100 || lo >= hi {
+		return 0, 0, fmt.Errorf("invalid measure-window %q: bounds must satisfy 0 <= from < to <= 100", s)
+	}
+	return lo / 100, hi / 100, nil
+}
+
+// filterMeasureWindow keeps the runs whose start time falls between the lo and
+// hi fractions of the [start, end] wall-clock interval.
+func filterMeasureWindow(all []runMetrics, start, end time.Time, lo, hi float64) []runMetrics {
+	wall := end.Sub(start)
+	from := start.Add(time.Duration(float64(wall) * lo))
+	to := start.Add(time.Duration(float64(wall) * hi))
+	var in []runMetrics
+	for _, m := range all {
+		if !m.StartedAt.Before(from) && !m.StartedAt.After(to) {
+			in = append(in, m)
+		}
+	}
+	return in
+}
+
+// tokenDist is a distribution max_tokens is drawn from for each run.
+type tokenDist struct {
+	min, max int
+}
+
+// parseTokenDist parses "fixed:N" or "uniform:MIN-MAX".
+func parseTokenDist(s string) (tokenDist, error) {
+	kind, spec, ok := strings.Cut(s, ":")
+	if !ok {
+		return tokenDist{}, fmt.Errorf("invalid max-tokens-dist %q (expected fixed:N or uniform:MIN-MAX)", s)
+	}
+	switch kind {
+	case "fixed":
+		n, err := strconv.Atoi(spec)
+		if err != nil || n <= 0 {
+			return tokenDist{}, fmt.Errorf("invalid max-tokens-dist %q: N must be a positive integer", s)
+		}
+		return tokenDist{min: n, max: n}, nil
+	case "uniform":
+		from, to, ok := strings.Cut(spec, "-")
+		if !ok {
+			return tokenDist{}, fmt.Errorf("invalid max-tokens-dist %q (expected uniform:MIN-MAX)", s)
+		}
+		lo, err1 := strconv.Atoi(from)
+		hi, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || lo <= 0 || lo > hi {
+			return tokenDist{}, fmt.Errorf("invalid max-tokens-dist %q: need 0 < MIN <= MAX", s)
+		}
+		return tokenDist{min: lo, max: hi}, nil
+	default:
+		return tokenDist{}, fmt.Errorf("invalid max-tokens-dist %q: unknown distribution %q", s, kind)
+	}
+}
+
+func (d tokenDist) draw(rng *rand.Rand) int {
+	if d.min == d.max {
+		return d.min
+	}
+	return d.min + rng.Intn(d.max-d.min+1)
+}
+
+// thinkTime is the distribution a virtual user's pause between turns, and
+// before its next run, is drawn from.
+type thinkTime struct {
+	min, max time.Duration
+}
+
+// parseThinkTime parses a plain duration, "fixed:DUR", "uniform:MIN-MAX"
+// or a bare "MIN-MAX" range.
+func parseThinkTime(s string) (thinkTime, error) {
+	kind, spec, ok := strings.Cut(s, ":")
+	if !ok {
+		kind, spec = "fixed", s
+		if strings.Index(s, "-") > 0 {
+			kind = "uniform"
+		}
+	}
+	switch kind {
+	case "fixed":
+		d, err := time.ParseDuration(spec)
+		if err != nil || d < 0 {
+			return thinkTime{}, fmt.Errorf("invalid think-time %q: need a non-negative duration", s)
+		}
+		return thinkTime{min: d, max: d}, nil
+	case "uniform":
+		from, to, ok := strings.Cut(spec, "-")
+		if !ok {
+			return thinkTime{}, fmt.Errorf("invalid think-time %q (expected MIN-MAX)", s)
+		}
+		lo, err1 := time.ParseDuration(from)
+		hi, err2 := time.ParseDuration(to)
+		if err1 != nil || err2 != nil || lo < 0 || lo > hi {
+			return thinkTime{}, fmt.Errorf("invalid think-time %q: need 0 <= MIN <= MAX", s)
+		}
+		return thinkTime{min: lo, max: hi}, nil
+	default:
+		return thinkTime{}, fmt.Errorf("invalid think-time %q: unknown distribution %q", s, kind)
+	}
+}
+
+// rampWindows is how many time windows the summary of a --ramp benchmark
+// splits the results into.
+const rampWindows = 10
+
+// rampSchedule raises the concurrency limit linearly from from to to over
+// the given time, then holds it at to.
+type rampSchedule struct {
+	from, to int
+	over     time.Duration
+}
+
+// parseRamp parses "FROM:TO:DURATION", e.g. "1:50:10s".
+func parseRamp(s string) (rampSchedule, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return rampSchedule{}, fmt.Errorf("invalid ramp %q (expected FROM:TO:DURATION, e.g. 1:50:10s)", s)
+	}
+	from, err1 := strconv.Atoi(parts[0])
+	to, err2 := strconv.Atoi(parts[1])
+	over, err3 := time.ParseDuration(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || from < 1 || from > to || over <= 0 {
+		return rampSchedule{}, fmt.Errorf("invalid ramp %q: need 1 <= FROM <= TO and a positive duration", s)
+	}
+	return rampSchedule{from: from, to: to, over: over}, nil
+}
+
+// at returns the concurrency limit the schedule sets elapsed into the run.
+func (r rampSchedule) at(elapsed time.Duration) int {
+	if elapsed >= r.over {
+		return r.to
+	}
+	return r.from + int(float64(r.to-r.from)*float64(elapsed)/float64(r.over))
+}
+
+// repeatedFlag collects every occurrence of a flag verbatim. Unlike
+// cli.StringSliceFlag it doesn't split on commas, which JSON values need.
+type repeatedFlag []string
+
+func (f *repeatedFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func (f *repeatedFlag) String() string { return strings.Join(*f, " ") }
+
+// parseModels splits a comma-separated --model list.
+func parseModels(s string) []string {
+	var models []string
+	for _, m := range strings.Split(s, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// parseParams turns repeated --param key=value flags into request body
+// fields. A value that parses as JSON (a number, true, an object, ...) is
+// sent as that JSON; anything else is sent as a string.
+func parseParams(specs []string) (map[string]any, error) {
+	params := map[string]any{}
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid param %q (expected key=value)", spec)
+		}
+		dec := json.NewDecoder(strings.NewReader(value))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil || dec.More() {
+			v = value
+		}
+		params[key] = v
+	}
+	return params, nil
+}
+
+func (t thinkTime) draw(rng *rand.Rand) time.Duration {
+	if t.min == t.max {
+		return t.min
+	}
+	return t.min + time.Duration(rng.Int63n(int64(t.max-t.min)+1))
+}
+
+// shouldRetry reports whether a failed attempt is worth retrying: transport
+// errors and 429, 500, 502, 503 and 504 responses, unless that status is the
+// one we expect. Anything else, such as a 400, fails straight away.
+func shouldRetry(resp *http.Response, err error, expectStatus int) bool {
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode == expectStatus {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay is the wait before retry number attempt (from 1): the server's
+// Retry-After when it sent one, otherwise base doubled for every attempt.
+func retryDelay(resp *http.Response, base time.Duration, attempt int) time.Duration {
+	if resp != nil {
+		if v := strings.TrimSpace(resp.Header.Get("Retry-After")); v != "" {
+			if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second
+			}
+			if at, err := http.ParseTime(v); err == nil {
+				return max(time.Until(at), 0)
+			}
+		}
+	}
+	return base << min(attempt-1, 16)
+}
+
+// retryBudget is a token bucket shared by every run so that a mass failure
+// can't snowball into a retry storm against a backend that is already
+// struggling. A nil budget never runs out.
+type retryBudget struct {
+	mu        sync.Mutex
+	remaining int
+	exhausted int
+
+	// With no run count up front (--duration), the budget instead grows by
+	// fraction for every run dispatched.
+	fraction float64
+	credit   float64
+}
+
+// newRetryBudget allows retries worth fraction of the total number of runs,
+// or unlimited retries when fraction is zero. A runs of zero means the total
+// isn't known and the budget accrues as runs are dispatched.
+func newRetryBudget(fraction float64, runs int) *retryBudget {
+	if fraction <= 0 {
+		return nil
+	}
+	if runs <= 0 {
+		return &retryBudget{fraction: fraction}
+	}
+	return &retryBudget{remaining: int(math.Ceil(fraction * float64(runs)))}
+}
+
+// accrue credits the budget with one dispatched run's share of retries. It
+// is a no-op for budgets sized up front.
+func (b *retryBudget) accrue() {
+	if b == nil || b.fraction == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.credit += b.fraction
+	whole := math.Floor(b.credit)
+	b.remaining += int(whole)
+	b.credit -= whole
+}
+
+// take consumes one retry from the budget, reporting false once it is spent.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining <= 0 {
+		b.exhausted++
+		return false
+	}
+	b.remaining--
+	return true
+}
+
+// exhaustedCount returns how many retries were refused for lack of budget.
+func (b *retryBudget) exhaustedCount() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exhausted
+}
+
+// streamTracker follows the progress of concurrent streams so we can tell
+// whether the server interleaves tokens fairly or starves some streams.
+// All methods are safe to call on a nil tracker.
+type streamTracker struct {
+	mu      sync.Mutex
+	chunks  map[int]int
+	last    map[int]int
+	samples int
+	jainSum float64
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{chunks: map[int]int{}, last: map[int]int{}}
+}
+
+func (t *streamTracker) start(run int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.chunks[run] = 0
+	t.last[run] = 0
+	t.mu.Unlock()
+}
+
+func (t *streamTracker) chunk(run int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.chunks[run]++
+	t.mu.Unlock()
+}
+
+func (t *streamTracker) finish(run int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.chunks, run)
+	delete(t.last, run)
+	t.mu.Unlock()
+}
+
+// sample computes Jain's fairness index, (sum x)^2 / (n * sum x^2), over the
+// chunks each active stream received since the previous sample. 1.0 means
+// every stream progressed equally; 1/n means a single stream got everything.
+func (t *streamTracker) sample() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sum, sumSq float64
+	for run, n := range t.chunks {
+		x := float64(n - t.last[run])
+		t.last[run] = n
+		sum += x
+		sumSq += x * x
+	}
+	if len(t.chunks) < 2 || sumSq == 0 {
+		return
+	}
+	t.jainSum += sum * sum / (float64(len(t.chunks)) * sumSq)
+	t.samples++
+}
+
+// sampleEvery samples at the given interval until ctx is cancelled.
+func (t *streamTracker) sampleEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sample()
+		}
+	}
+}
+
+// fairness returns the mean fairness index and the number of samples taken.
+func (t *streamTracker) fairness() (float64, int) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.samples == 0 {
+		return 0, 0
+	}
+	return t.jainSum / float64(t.samples), t.samples
+}
+
+// streamChunk is a chunk of generated output: when it arrived and where its
+// text starts in the reply. Tool-call chunks add no text.
+type streamChunk struct {
+	at     time.Time
+	offset int
+}
+
+// interTokenLatency returns the mean and p95 gap in milliseconds between
+// consecutive chunks of a stream. A stream of fewer than two chunks has no
+// gaps and reports zero for both.
+func interTokenLatency(chunks []streamChunk) (mean, p95 float64) {
+	if len(chunks) < 2 {
+		return 0, 0
+	}
+	gaps := make([]float64, len(chunks)-1)
+	var total float64
+	for i := 1; i < len(chunks); i++ {
+		gaps[i-1] = chunks[i].at.Sub(chunks[i-1].at).Seconds() * 1e3
+		total += gaps[i-1]
+	}
+	sort.Float64s(gaps)
+	return total / float64(len(gaps)), percentile(gaps, 95)
+}
+
+// writeTimeseries writes a stream's generation curve for --timeseries-dir:
+// one row per chunk with its arrival time since the request was sent, the
+// estimated tokens it carried and the running total. Flat stretches of
+// cumulative_tokens are stalls.
+func writeTimeseries(dir string, run, turn int, start time.Time, content string, chunks []streamChunk) (string, error) {
+	filename := fmt.Sprintf("%s/%03d.%s.csv", dir, run, turnKind(turn, "timeseries"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return filename, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write([]string{"elapsed_ms", "tokens", "cumulative_tokens"})
+	var total int
+	for i, c := range chunks {
+		end := len(content)
+		if i+1 < len(chunks) {
+			end = chunks[i+1].offset
+		}
+		n := countTokens(content[c.offset:end])
+		total += n
+		w.Write([]string{
+			strconv.FormatFloat(c.at.Sub(start).Seconds()*1e3, 'f', 3, 64),
+			strconv.Itoa(n), strconv.Itoa(total),
+		})
+	}
+	w.Flush()
+	if err := os.WriteFile(filename, []byte(b.String()), 0644); err != nil {
+		return filename, fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	return filename, nil
+}
+
+// runWarmup sends n runs exactly like the measured batch and keeps their
+// metrics out of the summary, so model loading and cold caches don't skew
+// it. The runs are still logged. It returns how many were dispatched and
+// the successful runs, which the cold-start comparison reports on.
+func runWarmup(ctx context.Context, cfg *benchConfig, rng *rand.Rand, n, conc int, retryBudget float64) (int, []runMetrics) {
+	warm := *cfg
+	warm.Duration = 0
+	warm.RetryBudget = newRetryBudget(retryBudget, n)
+	warm.Progress = nil
+	warm.Errors = nil
+	warm.Ramp = nil
+	// The cold-start comparison needs every warmup run; there are only n.
+	warm.KeepRuns = true
+	if conc <= 0 || conc > n {
+		conc = n
+	}
+	infof("Warmup | sending %d runs", n)
+	res := runBenchmark(ctx, &warm, rng, n, conc, nil)
+	infof("Warmup | %d / %d succeeded; metrics discarded", len(res.Runs), res.Dispatched)
+	return res.Dispatched, res.Runs
+}
+
+// grpcOptions names the KServe v2 tensors used by the grpc style.
+type grpcOptions struct {
+	InputName      string
+	OutputName     string
+	MaxTokensInput string
+}
+
+func callGRPC(
+	ctx context.Context,
+	run int,
+	cfg *benchConfig,
+	maxTokens, promptIndex int,
+	ch chan<- runMetrics,
+) bool {
+	gc, model, prompt, tpsMode := cfg.GRPC, cfg.Model, cfg.prompt(promptIndex), cfg.TPSMode
+	dataDir, storeData := cfg.DataDir, cfg.StoreData
+
+	promptTokens := countTokens(prompt)
+	logEvent(run, "request", logFields{"model": model, "stream": false, "prompt_tokens": promptTokens})
+
+	start := time.Now()
+	text, err := gc.infer(ctx, model, prompt, maxTokens)
+	if err != nil {
+		logEvent(run, "error", logFields{"type": "grpc", "error": err.Error()})
+		cfg.Errors.record("grpc", err.Error())
+		return false
+	}
+	elapsed := time.Since(start)
+
+	completionTokens := countTokens(text)
+	metrics := runMetrics{
+		Run:              run,
+		Model:            model,
+		Stream:           false,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+		TokenSource:      "estimate",
+		LatencyMs:        elapsed.Seconds() * 1e3,
+		MaxTokens:        maxTokens,
+		PromptIndex:      datasetIndex(promptIndex),
+		StartedAt:        start,
+	}
+	metrics.setRates(tpsMode)
+	metrics.CostUSD = cfg.Pricing.cost(metrics)
+	if !cfg.checkReply(run, text, metrics) {
+		return false
+	}
+	logEvent(run, "success", metrics.ToMap())
+	if storeData {
+		persistRun(dataDir, run, 1, text, metrics)
+	}
+
+	ch <- metrics
+	return true
+}
+
+// requestContext returns the context a run's requests are sent under: ctx
+// without its cancellation, but cancelled along with cfg.Abort.
+func (cfg *benchConfig) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	reqCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	if cfg.Abort == nil {
+		return reqCtx, func() { cancel(nil) }
+	}
+	stop := context.AfterFunc(cfg.Abort, func() { cancel(context.Cause(cfg.Abort)) })
+	return reqCtx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// runSession plays one virtual user. With a single turn it is just one
+// request; with more, each reply is appended to the conversation and,
+// after the think time, the follow-up is sent with the whole history so
+// later turns carry a growing context. A failed turn ends the session, as
+// does the end of the run during a think time, so runSession reports how
+// many turns it sent and whether every one of them succeeded.
+func runSession(
+	ctx context.Context,
+	run int,
+	cfg *benchConfig,
+	maxTokens, promptIndex int,
+	think []time.Duration,
+	ch chan<- runMetrics,
+	tracker *streamTracker,
+) (sent int, ok bool) {
+	// Requests already started are allowed to finish after an interrupt
+	// unless cfg.Abort cancels them; only the pause before the next turn
+	// watches ctx.
+	reqCtx, cancel := cfg.requestContext(ctx)
+	defer cancel()
+	history := cfg.openingMessages(promptIndex)
+	if cfg.Turns <= 1 {
+		_, ok := callAPI(reqCtx, run, 0, cfg, maxTokens, promptIndex, history, ch, tracker)
+		return 1, ok
+	}
+
+	for turn := 1; turn <= cfg.Turns; turn++ {
+		reply, ok := callAPI(reqCtx, run, turn, cfg, maxTokens, promptIndex, history, ch, tracker)
+		if !ok || turn == cfg.Turns {
+			return turn, ok
+		}
+		history = append(history,
+			chatMessage{Role: "assistant", Content: reply},
+			chatMessage{Role: "user", Content: cfg.FollowUp},
+		)
+		select {
+		case <-ctx.Done():
+			return turn, true
+		case <-time.After(think[turn-1]):
+		}
+	}
+	return cfg.Turns, true
+}
+
+// benchResult is the outcome of one pass of the dispatch loop.
+type benchResult struct {
+	// Runs are the successful runs in arrival order, as collected by Agg,
+	// when cfg.KeepRuns is set.
+	Runs       []runMetrics
+	Agg        *aggregator
+	Dispatched int
+	// Requests counts the requests actually sent, per model in
+	// ModelRequests; sessions cut short send fewer than cfg.Turns.
+	Requests      int
+	ModelRequests map[string]int
+	// LastDispatch is when the final run was sent, for the dispatch rate.
+	LastDispatch time.Time
+	Start        time.Time
+	End          time.Time
+	Tracker      *streamTracker
+}
+
+// runBenchmark sends runs requests with at most conc in flight and collects
+// the metrics of the successful ones. With cfg.Duration set, runs is ignored
+// and requests keep being dispatched until the duration has passed. onResult,
+// when non-nil, is called for each result as it arrives, including streams
+// cut off by cfg.Abort, which are marked Cancelled and not aggregated.
+func runBenchmark(ctx context.Context, cfg *benchConfig, rng *rand.Rand, runs, conc int, onResult func(runMetrics)) benchResult {
+	var tracker *streamTracker
+	if cfg.Stream && conc > 1 {
+		tracker = newStreamTracker()
+		sampleCtx, stopSampling := context.WithCancel(ctx)
+		defer stopSampling()
+		go tracker.sampleEvery(sampleCtx, cfg.FairnessInterval)
+	}
+
+	// Results are aggregated while dispatching since a --duration run has
+	// no upper bound to size the channel by; the channel only has to
+	// absorb the runs in flight.
+	results := make(chan runMetrics, conc)
+	agg := &aggregator{keep: cfg.KeepRuns, waves: waveTracker{tolerance: cfg.WaveTolerance}}
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for m := range results {
+			if !m.Cancelled {
+				agg.add(m)
+				cfg.Progress.result(m)
+			}
+			if onResult != nil {
+				onResult(m)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, conc)
+
+	dispatchCtx := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		dispatchCtx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+
+	// A ramp starts with the slots above its first level taken by
+	// placeholders and frees one at each step, so the semaphore's effective
+	// size follows the schedule. Runs release whichever token they find,
+	// which keeps the count right.
+	if r := cfg.Ramp; r != nil && conc > r.from {
+		steps := conc - r.from
+		for range steps {
+			sem <- struct{}{}
+		}
+		rampCtx, stopRamp := context.WithCancel(dispatchCtx)
+		defer stopRamp()
+		go func() {
+			for k := 1; k <= steps; k++ {
+				select {
+				case <-time.After(time.Until(start.Add(r.over * time.Duration(k) / time.Duration(steps)))):
+					<-sem
+					infof("Ramp | concurrency=%d", r.from+k)
+				case <-rampCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// A ticker rather than a token bucket: missed ticks are dropped, so a
+	// backlog behind --concurrency never turns into a burst afterwards.
+	var pace <-chan time.Time
+	if cfg.RPS > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.RPS))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	var lastDispatch time.Time
+	dispatched := 0
+	var sentMu sync.Mutex
+	sent := make(map[string]int)
+	for i := 1; cfg.Duration > 0 || i <= runs; i++ {
+		maxTokens := cfg.MaxTokens
+		if cfg.MaxTokensDist != nil {
+			maxTokens = cfg.MaxTokensDist.draw(rng)
+		}
+
+		// Think times are drawn here rather than in the sessions so the
+		// sequence stays reproducible under --rng-seed.
+		var think []time.Duration
+		if cfg.Turns > 1 {
+			think = make([]time.Duration, cfg.Turns-1)
+			for t := range think {
+				think[t] = cfg.ThinkTime.draw(rng)
+			}
+		}
+		// After its run the user pauses before the next one, holding its
+		// slot. The last runs of a fixed count have no successor to delay.
+		var pause time.Duration
+		if cfg.Duration > 0 || i+conc <= runs {
+			pause = cfg.ThinkTime.draw(rng)
+		}
+		promptIndex := -1
+		if cfg.Dataset != nil {
+			promptIndex = cfg.Dataset.pick(i, rng)
+		}
+
+		if pace != nil && i > 1 {
+			select {
+			case <-pace:
+			case <-dispatchCtx.Done():
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-dispatchCtx.Done():
+		}
+		if ctx.Err() != nil {
+			infof("Interrupted | stopped dispatching after %d runs; waiting for in-flight runs (Ctrl+C again to cancel them)", i-1)
+			break
+		}
+		if dispatchCtx.Err() != nil {
+			infof("Duration | %s elapsed after dispatching %d runs; waiting for in-flight runs", cfg.Duration, i-1)
+			break
+		}
+		cfg.RetryBudget.accrue()
+		dispatched++
+		lastDispatch = time.Now()
+		wg.Add(1)
+		// Models take turns run by run so each sees the same load.
+		runCfg := cfg
+		if len(cfg.Models) > 1 {
+			c := *cfg
+			c.Model = cfg.Models[(i-1)%len(cfg.Models)]
+			runCfg = &c
+		}
+		go func(cfg *benchConfig, run, maxTokens, promptIndex int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if pause > 0 {
+					select {
+					case <-time.After(pause):
+					case <-dispatchCtx.Done():
+					}
+				}
+			}()
+			n, ok := 1, false
+			if cfg.Style == "grpc" {
+				reqCtx, cancel := cfg.requestContext(ctx)
+				defer cancel()
+				ok = callGRPC(reqCtx, run, cfg, maxTokens, promptIndex, results)
+			} else {
+				n, ok = runSession(dispatchCtx, run, cfg, maxTokens, promptIndex, think, results, tracker)
+			}
+			sentMu.Lock()
+			sent[cfg.Model] += n
+			sentMu.Unlock()
+			cfg.Progress.runDone(ok)
+		}(runCfg, i, maxTokens, promptIndex)
+	}
+
+	wg.Wait()
+	close(results)
+	<-collected
+	requests := 0
+	for _, n := range sent {
+		requests += n
+	}
+	return benchResult{Runs: agg.all(), Agg: agg, Dispatched: dispatched, Requests: requests, ModelRequests: sent, LastDispatch: lastDispatch, Start: start, End: time.Now(), Tracker: tracker}
+}
+
+// runSweep runs the benchmark once per concurrency level and prints a table
+// of latency and aggregate throughput per level, optionally also as CSV.
+func runSweep(ctx context.Context, cfg *benchConfig, rng *rand.Rand, runs int, levels []int, csvPath, outputFormat string) error {
+	var csvw *csv.Writer
+	if csvPath != "" {
+		f, err := os.Create(csvPath)
+		if err != nil {
+			return fmt.Errorf("error creating sweep csv: %w", err)
+		}
+		defer f.Close()
+		csvw = csv.NewWriter(f)
+		csvw.Write([]string{"concurrency", "runs", "successful", "avg_latency_ms", "p99_latency_ms", "agg_tok_per_sec"})
+	}
+
+	type row struct {
+		conc, good, requests   int
+		avgLat, p99Lat, aggTPS float64
+	}
+	var rows []row
+	for _, level := range levels {
+		conc := level
+		if conc <= 0 || (runs > 0 && conc > runs) {
+			conc = runs
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if cfg.Duration > 0 {
+			infof("Sweep | concurrency=%d | duration=%s", conc, cfg.Duration)
+		} else {
+			infof("Sweep | concurrency=%d | runs=%d", conc, runs)
+		}
+		res := runBenchmark(ctx, cfg, rng, runs, conc, nil)
+
+		stats := res.Agg.summary()
+		r := row{conc: conc, good: stats.Runs, requests: res.Requests}
+		if r.good > 0 {
+			r.avgLat = stats.Latency.Avg
+			r.p99Lat = stats.Latency.P99
+			r.aggTPS, _ = perSecond(float64(stats.CompletionTokens), res.End.Sub(res.Start).Seconds())
+		}
+		rows = append(rows, r)
+
+		if csvw != nil {
+			csvw.Write([]string{
+				strconv.Itoa(r.conc), strconv.Itoa(r.requests), strconv.Itoa(r.good),
+				strconv.FormatFloat(r.avgLat, 'f', 2, 64),
+				strconv.FormatFloat(r.p99Lat, 'f', 2, 64),
+				strconv.FormatFloat(r.aggTPS, 'f', 2, 64),
+			})
+		}
+	}
+
+	switch outputFormat {
+	case "json":
+		type level struct {
+			Concurrency  int     `json:"concurrency"`
+			Requests     int     `json:"requests"`
+			Successful   int     `json:"successful"`
+			AvgLatencyMs float64 `json:"avg_latency_ms"`
+			P99LatencyMs float64 `json:"p99_latency_ms"`
+			AggTokPerSec float64 `json:"agg_tok_per_sec"`
+		}
+		levels := make([]level, len(rows))
+		for i, r := range rows {
+			levels[i] = level{r.conc, r.requests, r.good, r.avgLat, r.p99Lat, r.aggTPS}
+		}
+		if err := writeJSON(os.Stdout, map[string]any{"sweep": levels}); err != nil {
+			return fmt.Errorf("error writing json sweep: %w", err)
+		}
+	case "markdown":
+		fmt.Printf("\n### Concurrency sweep\n\n")
+		cells := make([][]string, len(rows))
+		for i, r := range rows {
+			cells[i] = []string{
+				strconv.Itoa(r.conc), fmt.Sprintf("%d/%d", r.good, r.requests),
+				fmt.Sprintf("%.2f", r.avgLat), fmt.Sprintf("%.2f", r.p99Lat), fmt.Sprintf("%.2f", r.aggTPS),
+			}
+		}
+		writeMarkdownTable(os.Stdout, []string{"Concurrency", "Successful", "Avg latency ms", "p99 latency ms", "Agg tok/s"}, cells)
+	default:
+		fmt.Printf("\n=== Concurrency sweep ===\n")
+		fmt.Printf("%11s  %10s  %14s  %14s  %10s\n", "Concurrency", "Successful", "Avg latency ms", "p99 latency ms", "Agg tok/s")
+		for _, r := range rows {
+			fmt.Printf("%11d  %10s  %14.2f  %14.2f  %10.2f\n", r.conc, fmt.Sprintf("%d/%d", r.good, r.requests), r.avgLat, r.p99Lat, r.aggTPS)
+		}
+	}
+
+	if csvw != nil {
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			return fmt.Errorf("error writing sweep csv: %w", err)
+		}
+	}
+	return nil
+}
+
+// preloadKeepAlive keeps a preloaded model in memory through pauses in the
+// benchmark, such as long think times, which would outlast Ollama's default
+// of five minutes. --unload-model still evicts it at the end.
+const preloadKeepAlive = "30m"
+
+// preloadModel asks Ollama to load the model without generating anything,
+// so the first timed run doesn't pay for it. It returns the server's
+// load_duration and the time the whole request took.
+func preloadModel(ctx context.Context, client *http.Client, baseURL, model string) (load, elapsed time.Duration, err error) {
+	endpoint := strings.TrimRight(baseURL, "/") + "/generate"
+	body, _ := json.Marshal(map[string]any{
+		"model":      model,
+		"keep_alive": preloadKeepAlive,
+	})
+	req, _ := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error preloading model %s: %w", model, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	elapsed = time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return 0, elapsed, fmt.Errorf("error preloading model %s: %s (status code %d)", model, strings.TrimSpace(string(raw)), resp.StatusCode)
+	}
+	var or ollamaResp
+	if err := json.Unmarshal(raw, &or); err != nil {
+		return 0, elapsed, fmt.Errorf("error preloading model %s: %w", model, err)
+	}
+	return time.Duration(or.LoadDuration), elapsed, nil
+}
+
+// unloadModel asks Ollama to evict the model from memory.
+func unloadModel(ctx context.Context, client *http.Client, baseURL, model string) error {
+	endpoint := strings.TrimRight(baseURL, "/") + "/chat"
+	body, _ := json.Marshal(map[string]any{
+		"model":      model,
+		"keep_alive": 0,
+	})
+	req, _ := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error unloading model: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error unloading model: %s (status code %d)", strings.TrimSpace(string(raw)), resp.StatusCode)
+	}
+	return nil
+}
+
+func main() {
+	// Cancelled by the second interrupt; see below.
+	abortCtx, abortRequests := context.WithCancelCause(context.Background())
+	app := &cli.App{
+		Name:  "llmbench",
+		Usage: "tiny load-tester for OpenAI & Ollama like chat APIs",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "dry-run", Usage: "print the first run's request (URL, headers with the key redacted, body) and exit without sending anything"},
+			&cli.StringFlag{Name: "config", Usage: "YAML file of flag defaults keyed by flag name; command-line flags override it"},
+			&cli.StringFlag{Name: "base-url", Value: "https://api.openai.com/v1", Usage: "API base URL"},
+			&cli.StringFlag{Name: "key", EnvVars: []string{"LLM_API_KEY"}, Usage: "Bearer token (not used by Ollama); @- reads it from stdin"},
+			&cli.StringFlag{Name: "key-file", Usage: "read the API key from this file instead of --key, keeping it out of shell history and ps"},
+			&cli.StringFlag{Name: "style", Value: "openai", Usage: "API style: openai, ollama, anthropic, gemini, cohere, bedrock (AWS), grpc (KServe v2 / Triton) or custom (--request-template)"},
+			&cli.StringFlag{Name: "request-template", Usage: "Go text/template file rendering the JSON request body for --style custom; requests are POSTed to --base-url as given"},
+			&cli.StringFlag{Name: "content-path", Usage: "dotted path to the reply text in a --style custom response, e.g. choices.0.message.content"},
+			&cli.StringFlag{Name: "prompt-tokens-path", Usage: "dotted path to the prompt token count in a --style custom response (default: estimate)"},
+			&cli.StringFlag{Name: "completion-tokens-path", Usage: "dotted path to the completion token count in a --style custom response (default: estimate)"},
+			&cli.StringFlag{Name: "endpoint", Value: "chat", Usage: "OpenAI style endpoint: chat (/chat/completions) or completions (/completions, sends a plain prompt)"},
+			&cli.StringFlag{Name: "region", Usage: "AWS region for --style bedrock; defaults to AWS_REGION or the profile's region"},
+			&cli.BoolFlag{Name: "stream", Usage: "enable streaming (SSE) mode"},
+			&cli.IntFlag{Name: "runs", Value: 100, Usage: "total requests to send"},
+			&cli.IntFlag{Name: "warmup", Usage: "send this many runs first and leave them out of the summary, CSV and JSON"},
+			&cli.DurationFlag{Name: "duration", Usage: "keep sending requests for this long instead of a fixed --runs (needs --concurrency)"},
+			&cli.IntFlag{Name: "concurrency", Value: 0, Usage: "simultaneous requests (0 = runs)"},
+			&cli.Float64Flag{Name: "rps", Usage: "pace dispatch to this many runs per second, independent of --concurrency (0 = as fast as concurrency allows)"},
+			&cli.StringFlag{Name: "ramp", Usage: "raise concurrency linearly FROM:TO:DURATION (e.g. 1:50:10s), then hold at TO; the summary splits results into time windows"},
+			&cli.IntSliceFlag{Name: "concurrency-sweep", Usage: "run the benchmark at each listed concurrency (e.g. 1,2,4,8) and print a scaling table"},
+			&cli.IntSliceFlag{Name: "prompt-lengths", Usage: "run the benchmark with a synthesized prompt of about each listed token count (e.g. 100,500,1000,4000) and print a prefill scaling table"},
+			&cli.StringFlag{Name: "sweep-csv", Usage: "also write the concurrency sweep or prompt length table to this CSV file"},
+			&cli.IntFlag{Name: "max-tokens", Aliases: []string{"max-completion-tokens"}, Value: 4096, Usage: "completion token limit per request (max_tokens; num_predict for Ollama, maxOutputTokens for Gemini)"},
+			&cli.BoolFlag{Name: "use-max-completion-tokens", Usage: "send the OpenAI chat limit as max_completion_tokens, which o1 and newer models require; OpenAI deprecates max_tokens for them"},
+			&cli.StringFlag{Name: "max-tokens-dist", Usage: "draw max_tokens per run from fixed:N or uniform:MIN-MAX (overrides --max-tokens)"},
+			&cli.StringFlag{Name: "model", Value: "gpt-4o-mini", Usage: "model ID, or a comma-separated list to compare models side by side (--runs is then per model)"},
+			&cli.StringFlag{Name: "prompt", Value: "Explain the fundamental concepts of relativity in detail.", Usage: "user message"},
+			&cli.StringFlag{Name: "prompt-file", Usage: "read the user message from this file (- for stdin)"},
+			&cli.StringFlag{Name: "prompt-dataset", Usage: "send one prompt per run from this file: one prompt per line, or JSONL with a \"prompt\" field"},
+			&cli.StringFlag{Name: "prompt-sampling", Value: "round-robin", Usage: "how runs pick from --prompt-dataset: round-robin or random (seeded by --rng-seed)"},
+			&cli.StringFlag{Name: "system", Usage: "system prompt sent before the user message (not used by grpc)"},
+			&cli.StringFlag{Name: "system-file", Usage: "read the system prompt from this file"},
+			&cli.IntFlag{Name: "turns", Value: 1, Usage: "turns per virtual user; each follow-up carries the whole conversation so far"},
+			&cli.StringFlag{Name: "follow-up", Value: "Please go on and expand on that.", Usage: "user message sent on every turn after the first"},
+			&cli.StringFlag{Name: "think-time", Value: "0s", Usage: "pause between a virtual user's turns and before its next run: DUR, fixed:DUR or MIN-MAX (also uniform:MIN-MAX)"},
+			&cli.StringFlag{Name: "tokenizer", Value: "whitespace", Usage: "how to count tokens the server doesn't report: whitespace, tiktoken (encoding from --model) or tiktoken:ENCODING (e.g. tiktoken:o200k_base)"},
+			&cli.Float64Flag{Name: "temperature", Value: 0.7, Usage: "sampling temperature (OpenAI, Gemini, Cohere and Bedrock)"},
+			&cli.Float64Flag{Name: "top-p", Usage: "nucleus sampling top_p, sent only when set (OpenAI, Gemini, Cohere and Bedrock)"},
+			&cli.Float64Flag{Name: "presence-penalty", Usage: "presence_penalty, sent only when set (OpenAI, Gemini and Cohere)"},
+			&cli.Float64Flag{Name: "frequency-penalty", Usage: "frequency_penalty, sent only when set (OpenAI, Gemini and Cohere)"},
+			&cli.GenericFlag{Name: "param", Value: &repeatedFlag{}, Usage: "extra request body field as key=value, repeatable; JSON values (numbers, booleans, objects) are sent as JSON and override every other field"},
+			&cli.StringFlag{Name: "tools", Usage: "JSON file with an array of tool definitions to send with every request"},
+			&cli.DurationFlag{Name: "timeout", Value: 60 * time.Second, Usage: "request timeout; when streaming it covers the whole stream (0 = none)"},
+			&cli.DurationFlag{Name: "stream-idle-timeout", Usage: "fail a streamed request when no data arrives for this long (0 = off)"},
+			&cli.StringFlag{Name: "tps", Value: "completion", Usage: "tokens/sec reported as tok_per_sec: completion (completion tokens / decode time, i.e. latency minus TTFT when streaming or Ollama's eval_duration; comparable across styles) or total (prompt + completion tokens / full latency)"},
+			&cli.BoolFlag{Name: "unload-model", Value: false, Usage: "unload model after all runs complete (Ollama only)"},
+			&cli.BoolFlag{Name: "preload", Aliases: []string{"warmup-model"}, Usage: "load each model into memory before the timed runs and log how long loading took, so the first run doesn't pay for it (Ollama only)"},
+			&cli.StringFlag{Name: "data-dir", Value: "./runs", Usage: "directory to save data files"},
+			&cli.BoolFlag{Name: "store-data", Value: false, Usage: "store data files (responses, metrics)"},
+			&cli.GenericFlag{Name: "header", Value: &repeatedFlag{}, Usage: "extra request header as \"Name: Value\", repeatable; overrides the built-in headers"},
+			&cli.StringFlag{Name: "oauth-token-url", Usage: "OAuth2 token endpoint; fetches the bearer via client credentials"},
+			&cli.StringFlag{Name: "oauth-client-id", Usage: "OAuth2 client ID"},
+			&cli.StringFlag{Name: "oauth-client-secret", EnvVars: []string{"LLM_OAUTH_CLIENT_SECRET"}, Usage: "OAuth2 client secret"},
+			&cli.StringSliceFlag{Name: "oauth-scope", Usage: "OAuth2 scope to request (repeatable)"},
+			&cli.IntFlag{Name: "retries", Usage: "retry transport errors and 429, 500, 502, 503 and 504 responses up to N times per run"},
+			&cli.DurationFlag{Name: "retry-backoff", Value: 500 * time.Millisecond, Usage: "delay before the first retry, doubled for each further attempt; a Retry-After header takes precedence"},
+			&cli.Float64Flag{Name: "retry-budget", Usage: "cap total retries at this fraction of --runs, shared by all runs (0 = unlimited)"},
+			&cli.StringFlag{Name: "expect-contains", Usage: "fail runs whose reply does not contain this text"},
+			&cli.StringFlag{Name: "think-tags", Usage: "for replies with <think>...</think> blocks: count estimates their reasoning_tokens when the usage doesn't report them; strip also removes them from the reply that is checked, stored and sent back on later turns"},
+			&cli.IntFlag{Name: "min-completion-tokens", Usage: "fail runs whose reply has fewer completion tokens than this"},
+			&cli.IntFlag{Name: "expect-status", Usage: "count runs answering with this HTTP status as passes and anything else as failures"},
+			&cli.BoolFlag{Name: "insecure-skip-verify", Usage: "do not verify the server's TLS certificate (self-signed test setups only)"},
+			&cli.StringFlag{Name: "cacert", Usage: "PEM file with CA certificates to trust in addition to the system pool"},
+			&cli.BoolFlag{Name: "fresh-connection", Aliases: []string{"no-keepalive"}, Usage: "disable keep-alive so every request opens a new connection"},
+			&cli.IntFlag{Name: "max-idle-conns", Usage: "idle connections kept open for reuse (default: Go's 100, of which 2 per host)"},
+			&cli.IntFlag{Name: "max-conns-per-host", Usage: "cap open connections to the endpoint; further requests wait for one to free up (0 = unlimited)"},
+			&cli.BoolFlag{Name: "all-models", Usage: "benchmark every model the Ollama server has installed (from /api/tags) side by side instead of --model; --runs is per model (ollama style only)"},
+			&cli.BoolFlag{Name: "list-models", Usage: "list the models served by the endpoint and exit"},
+			&cli.BoolFlag{Name: "preflight", Usage: "send one short request per model before the benchmark and exit with the server's answer if it fails"},
+			&cli.BoolFlag{Name: "check-model", Usage: "warn before the run if --model is not listed by the endpoint"},
+			&cli.Int64Flag{Name: "rng-seed", Aliases: []string{"seed"}, Usage: "seed for all random choices, making a benchmark reproducible (default: time-based, logged at startup)"},
+			&cli.StringFlag{Name: "measure-window", Usage: "only summarize runs that started within this part of the benchmark, e.g. 20%-80%"},
+			&cli.DurationFlag{Name: "wave-tolerance", Value: 10 * time.Millisecond, Usage: "runs starting within this interval of each other count as one wave"},
+			&cli.DurationFlag{Name: "fairness-interval", Value: 100 * time.Millisecond, Usage: "how often to sample per-stream progress for the fairness score (concurrent streaming only)"},
+			&cli.DurationFlag{Name: "healthcheck-interval", Usage: "probe the endpoint this often during the run and log outages (0 = off)"},
+			&cli.StringFlag{Name: "health-path", Value: "/health", Usage: "path probed by --healthcheck-interval, resolved against --base-url"},
+			&cli.StringFlag{Name: "request-deadline-header", Usage: "send the request's remaining deadline in milliseconds in this header, e.g. X-Request-Timeout"},
+			&cli.StringFlag{Name: "server-time-header", Usage: "response header with server-side processing time (default: openai-processing-ms, x-processing-time, x-response-time, server-timing)"},
+			&cli.StringFlag{Name: "log-level", Value: "info", Usage: "least severe log lines to print: info (every run's events), warn (retries, anomalies and errors) or error"},
+			&cli.StringFlag{Name: "log-format", Value: "text", Usage: "log line format: text, or json for one slog JSON object per line (time, level, msg, run, event and the event's fields)"},
+			&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "log only warnings and errors, not every request (same as --log-level warn); the summary is unaffected"},
+			&cli.BoolFlag{Name: "progress", Value: true, Usage: "show a live progress line on stderr (only when stderr is a terminal and --output isn't json)"},
+			&cli.Float64Flag{Name: "price-input", Usage: "USD per 1M prompt tokens, for the per-run cost_usd"},
+			&cli.Float64Flag{Name: "price-output", Usage: "USD per 1M completion tokens, for the per-run cost_usd"},
+			&cli.StringFlag{Name: "pricing-file", Usage: "JSON file mapping model names to {\"input\": N, \"output\": N} USD per 1M tokens; overrides --price-input/--price-output for the models it lists"},
+			&cli.StringFlag{Name: "csv", Usage: "write one row per successful run to this CSV file"},
+			&cli.StringFlag{Name: "pushgateway", Usage: "push summary metrics to this Prometheus pushgateway URL after the run"},
+			&cli.StringFlag{Name: "influx-file", Usage: "append each run's metrics to this file in InfluxDB line protocol"},
+			&cli.StringFlag{Name: "sqlite", Usage: "append the summary and every run to this SQLite database, creating it and its tables on first use"},
+			&cli.StringFlag{Name: "run-label", Usage: "label the --sqlite summary row (e.g. a commit hash) to tell benchmarks apart"},
+			&cli.StringFlag{Name: "timeseries-dir", Usage: "write each streamed run's per-chunk elapsed_ms and cumulative tokens to NNN.timeseries.csv in this directory (needs --stream)"},
+			&cli.StringFlag{Name: "jsonl", Usage: "append each run's metrics to this file as one JSON object per line"},
+			&cli.IntFlag{Name: "hist-buckets", Value: 10, Usage: "buckets in the summary's latency histogram"},
+			&cli.BoolFlag{Name: "no-hist", Usage: "leave the latency histogram out of the summary"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"output-format"}, Value: "text", Usage: "summary format: text, markdown (GitHub-flavored tables for issues and PRs) or json (stdout only; the text summary goes to stderr)"},
+			&cli.BoolFlag{Name: "json-summary", Usage: "shorthand for --output json"},
+			&cli.StringFlag{Name: "record", Usage: "record every HTTP exchange to this cassette file (JSON lines)"},
+			&cli.StringFlag{Name: "replay", Usage: "answer requests from this cassette file instead of the network"},
+			&cli.StringFlag{Name: "grpc-input", Value: "text_input", Usage: "name of the BYTES input tensor carrying the prompt (grpc only)"},
+			&cli.StringFlag{Name: "grpc-output", Value: "text_output", Usage: "name of the BYTES output tensor to read (grpc only)"},
+			&cli.StringFlag{Name: "grpc-max-tokens-input", Value: "max_tokens", Usage: "name of the INT32 max tokens input tensor, empty to omit (grpc only)"},
+		},
+		Before: func(c *cli.Context) error {
+			if path := c.String("config"); path != "" {
+				if err := applyConfigFile(c, path); err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+			}
+			return nil
+		},
+		Action: func(c *cli.Context) error {
+			start := time.Now()
+
+			level, err := parseLogLevel(c.String("log-level"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			if c.Bool("quiet") {
+				if c.IsSet("log-level") {
+					return cli.Exit("--quiet and --log-level are mutually exclusive", 1)
+				}
+				level = slog.LevelWarn
+			}
+			logLevel = level
+			switch c.String("log-format") {
+			case "text":
+			case "json":
+				logJSON = newJSONLogger()
+			default:
+				return cli.Exit(fmt.Sprintf("invalid log-format %q (expected text or json)", c.String("log-format")), 1)
+			}
+
+			style := strings.ToLower(c.String("style"))
+
+			dataDir := c.String("data-dir")
+			storeData := c.Bool("store-data")
+			if storeData && dataDir == "" {
+				return cli.Exit("data-dir must be set when store-data is enabled", 1)
+			}
+
+			if c.String("key") == "@-" && c.String("prompt-file") == "-" {
+				return cli.Exit("--key @- and --prompt-file - cannot both read stdin", 1)
+			}
+			apiKey, err := loadAPIKey(c.String("key"), c.String("key-file"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			oauthTokenURL := c.String("oauth-token-url")
+			replayPath := c.String("replay")
+			if style != "ollama" && style != "grpc" && style != "bedrock" && style != "custom" && apiKey == "" && oauthTokenURL == "" && replayPath == "" {
+				return cli.Exit("missing API key (use --key or --key-file, set LLM_API_KEY or configure --oauth-token-url)", 1)
+			}
+			recordPath := c.String("record")
+			if recordPath != "" && replayPath != "" {
+				return cli.Exit("--record and --replay are mutually exclusive", 1)
+			}
+			if style == "grpc" && (recordPath != "" || replayPath != "") {
+				return cli.Exit("--record and --replay are not supported for the grpc style", 1)
+			}
+
+			outputFormat := strings.ToLower(c.String("output"))
+			if c.Bool("json-summary") {
+				outputFormat = "json"
+			}
+			if outputFormat != "text" && outputFormat != "markdown" && outputFormat != "json" {
+				return cli.Exit(fmt.Sprintf("invalid --output %q: want text, markdown or json", c.String("output")), 1)
+			}
+
+			models := parseModels(c.String("model"))
+			if len(models) == 0 {
+				return cli.Exit("--model must name at least one model", 1)
+			}
+			if c.Bool("all-models") {
+				switch {
+				case style != "ollama":
+					return cli.Exit("--all-models is only supported for the ollama style", 1)
+				case c.IsSet("model"):
+					return cli.Exit("--all-models and --model are mutually exclusive", 1)
+				case c.Bool("dry-run"):
+					return cli.Exit("--all-models needs the server's model list and can't be combined with --dry-run", 1)
+				}
+			}
+			if style == "bedrock" {
+				for i, model := range models {
+					models[i] = bedrockModelID(model)
+					if bedrockFamily(models[i]) == "" {
+						return cli.Exit(fmt.Sprintf("unsupported Bedrock model %q: want an Anthropic Claude or Amazon Titan Text model ID", model), 1)
+					}
+					if models[i] != model {
+						infof("Bedrock | model %s -> %s", model, models[i])
+					}
+				}
+			}
+
+			// One tokenizer counts for every model, so the encoding can't
+			// follow the model name when there are several.
+			if c.String("tokenizer") == "tiktoken" && len(models) > 1 {
+				return cli.Exit("--tokenizer tiktoken picks the encoding from the model; with several models name one, e.g. --tokenizer tiktoken:o200k_base", 1)
+			}
+			tok, err := newTokenizer(c.String("tokenizer"), models[0])
+			if errors.Is(err, errUnknownTokenizer) {
+				return cli.Exit(err.Error(), 1)
+			}
+			if err != nil {
+				warnf("Warning: %v; falling back to whitespace token counts", err)
+				tok = whitespaceTokenizer{}
+			}
+			activeTokenizer = tok
+			infof("Tokenizer | %s", tok)
+
+			// With several models --runs is per model.
+			runs := c.Int("runs") * len(models)
+			conc := c.Int("concurrency")
+			var ramp *rampSchedule
+			if spec := c.String("ramp"); spec != "" {
+				if c.IsSet("concurrency") {
+					return cli.Exit("--ramp and --concurrency are mutually exclusive", 1)
+				}
+				if len(c.IntSlice("concurrency-sweep")) > 0 {
+					return cli.Exit("--ramp and --concurrency-sweep are mutually exclusive", 1)
+				}
+				r, err := parseRamp(spec)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				if c.Duration("duration") == 0 && r.to > runs {
+					return cli.Exit(fmt.Sprintf("--ramp peaks at %d concurrent runs but only %d runs are sent", r.to, runs), 1)
+				}
+				ramp, conc = &r, r.to
+			}
+			duration := c.Duration("duration")
+			if duration > 0 {
+				if c.IsSet("runs") {
+					return cli.Exit("--duration and --runs are mutually exclusive", 1)
+				}
+				if conc <= 0 {
+					return cli.Exit("--duration needs --concurrency (or --ramp) to bound the requests in flight", 1)
+				}
+				if ramp != nil && duration < ramp.over {
+					warnf("Warning: --duration %s ends before the --ramp reaches %d", duration, ramp.to)
+				}
+				for _, level := range c.IntSlice("concurrency-sweep") {
+					if level <= 0 {
+						return cli.Exit("--concurrency-sweep levels must be positive with --duration", 1)
+					}
+				}
+				runs = 0
+			} else if conc <= 0 || conc > runs {
+				conc = runs
+			}
+
+			if c.Int("hist-buckets") < 1 {
+				return cli.Exit("--hist-buckets must be at least 1", 1)
+			}
+
+			if c.Int("min-completion-tokens") < 0 {
+				return cli.Exit("--min-completion-tokens must not be negative", 1)
+			}
+			if expect := c.Int("expect-status"); expect != 0 && expect != http.StatusOK &&
+				(c.IsSet("expect-contains") || c.IsSet("min-completion-tokens")) {
+				return cli.Exit("--expect-contains and --min-completion-tokens need a parsed reply; they can't be combined with --expect-status other than 200", 1)
+			}
+
+			if c.IsSet("stream-idle-timeout") && !c.Bool("stream") {
+				return cli.Exit("--stream-idle-timeout needs --stream", 1)
+			}
+
+			warmup := c.Int("warmup")
+			if warmup < 0 {
+				return cli.Exit("--warmup must not be negative", 1)
+			}
+
+			if c.Float64("rps") < 0 {
+				return cli.Exit("--rps must not be negative", 1)
+			}
+
+			var gc *grpcClient
+			if style == "grpc" {
+				if c.Bool("stream") {
+					return cli.Exit("streaming is not supported for the grpc style", 1)
+				}
+				if c.Int("expect-status") != 0 {
+					return cli.Exit("--expect-status is not supported for the grpc style", 1)
+				}
+				var err error
+				gc, err = newGRPCClient(c.String("base-url"), apiKey, grpcOptions{
+					InputName:      c.String("grpc-input"),
+					OutputName:     c.String("grpc-output"),
+					MaxTokensInput: c.String("grpc-max-tokens-input"),
+				})
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				defer gc.Close()
+			}
+
+			var signer *awsSigner
+			if style == "bedrock" {
+				if c.Bool("stream") {
+					return cli.Exit("streaming is not supported for the bedrock style", 1)
+				}
+				if c.Bool("list-models") || (c.Bool("check-model") && !c.Bool("dry-run")) {
+					return cli.Exit("listing models is not supported for the bedrock style", 1)
+				}
+				var err error
+				signer, err = newAWSSigner(c.Context, c.String("region"))
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				if !c.IsSet("base-url") {
+					c.Set("base-url", signer.endpoint())
+				}
+			}
+
+			headers, err := parseHeaders(*c.Generic("header").(*repeatedFlag))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+
+			tlsConfig, err := loadTLSConfig(c.Bool("insecure-skip-verify"), c.String("cacert"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			if tlsConfig != nil && tlsConfig.InsecureSkipVerify {
+				warnf("Warning: TLS certificate verification is DISABLED (--insecure-skip-verify); the endpoint's identity is not checked and traffic can be intercepted")
+			}
+
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			if c.Bool("fresh-connection") {
+				// Every request dials a new connection so latency includes the
+				// full connection setup cost.
+				transport.DisableKeepAlives = true
+			}
+			if n := c.Int("max-idle-conns"); n < 0 {
+				return cli.Exit("--max-idle-conns must not be negative", 1)
+			} else if n > 0 {
+				// Every request goes to one host, so the per-host limit,
+				// which defaults to 2, is the one that matters.
+				transport.MaxIdleConns, transport.MaxIdleConnsPerHost = n, n
+				if c.Bool("fresh-connection") {
+					warnf("Warning: --max-idle-conns has no effect with --fresh-connection")
+				}
+			}
+			if n := c.Int("max-conns-per-host"); n < 0 {
+				return cli.Exit("--max-conns-per-host must not be negative", 1)
+			} else {
+				transport.MaxConnsPerHost = n
+			}
+
+			var rt http.RoundTripper = transport
+			if replayPath != "" {
+				cassette, err := loadCassette(replayPath)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				rt = cassette
+				infof("Cassette | replaying %s", replayPath)
+			}
+			if recordPath != "" {
+				f, err := os.Create(recordPath)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error creating cassette: %v", err), 1)
+				}
+				defer f.Close()
+				rt = newRecordingTransport(rt, f)
+				infof("Cassette | recording to %s", recordPath)
+			}
+
+			var client *http.Client
+			if c.Bool("stream") {
+				client = &http.Client{Timeout: 0, Transport: rt}
+			} else {
+				client = &http.Client{Timeout: c.Duration("timeout"), Transport: rt}
+			}
+
+			dryRun := c.Bool("dry-run")
+			if dryRun && style == "grpc" {
+				return cli.Exit("--dry-run is not supported for the grpc style", 1)
+			}
+
+			if oauthTokenURL != "" && !dryRun {
+				cfg := &clientcredentials.Config{
+					ClientID:     c.String("oauth-client-id"),
+					ClientSecret: c.String("oauth-client-secret"),
+					TokenURL:     oauthTokenURL,
+					Scopes:       c.StringSlice("oauth-scope"),
+				}
+				infof("OAuth | token_url=%s | client_id=%s | client_secret=%s | scope=%s",
+					cfg.TokenURL, cfg.ClientID, redact(cfg.ClientSecret), strings.Join(cfg.Scopes, " "))
+
+				// The token source caches the access token and fetches a new one
+				// shortly before it expires, so long runs keep a valid bearer.
+				tokenCtx := context.WithValue(c.Context, oauth2.HTTPClient, &http.Client{Timeout: c.Duration("timeout")})
+				ts := cfg.TokenSource(tokenCtx)
+				if _, err := ts.Token(); err != nil {
+					return cli.Exit(fmt.Sprintf("error fetching OAuth token: %v", err), 1)
+				}
+				client.Transport = &oauth2.Transport{Source: ts, Base: client.Transport}
+			}
+
+			// Replayed requests never leave the process, so they need no
+			// credentials.
+			if signer != nil && !dryRun && replayPath == "" {
+				if err := signer.check(c.Context); err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				client.Transport = signer.transport(client.Transport)
+			}
+
+			// --all-models replaces the --model list with what the server has
+			// installed, so the comparison matrix never goes stale.
+			if c.Bool("all-models") && !c.Bool("list-models") {
+				ids, err := fetchModels(c.Context, client, c.String("base-url"), apiKey, style, headers)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error listing models for --all-models: %v", err), 1)
+				}
+				if len(ids) == 0 {
+					return cli.Exit("--all-models: the server has no models installed", 1)
+				}
+				models = ids
+				runs = c.Int("runs") * len(models)
+				infof("Models | %d installed: %s", len(models), strings.Join(models, ", "))
+			}
+
+			if c.Bool("list-models") || (c.Bool("check-model") && !dryRun) {
+				if style == "grpc" || style == "custom" {
+					return cli.Exit(fmt.Sprintf("listing models is not supported for the %s style", style), 1)
+				}
+				ids, err := fetchModels(c.Context, client, c.String("base-url"), apiKey, style, headers)
+				if c.Bool("list-models") {
+					if err != nil {
+						return cli.Exit(fmt.Sprintf("error listing models: %v", err), 1)
+					}
+					for _, id := range ids {
+						fmt.Println(id)
+					}
+					return nil
+				}
+				if err != nil {
+					warnf("Warning: could not list models: %v", err)
+				} else {
+					for _, model := range models {
+						if !hasModel(ids, model) {
+							warnf("Warning: model %q is not listed by the endpoint; requests will likely fail", model)
+						}
+					}
+				}
+			}
+
+			var windowLo, windowHi float64
+			if mw := c.String("measure-window"); mw != "" {
+				var err error
+				windowLo, windowHi, err = parseMeasureWindow(mw)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+			}
+
+			tpsMode := strings.ToLower(c.String("tps"))
+			if tpsMode != "completion" && tpsMode != "total" {
+				return cli.Exit("tps must be completion or total", 1)
+			}
+
+			// All randomness is drawn from one seeded source in the dispatch
+			// loop so a benchmark can be replayed exactly.
+			seed := c.Int64("rng-seed")
+			if !c.IsSet("rng-seed") {
+				seed = time.Now().UnixNano()
+			}
+			rng := rand.New(rand.NewSource(seed))
+			infof("RNG | seed=%d", seed)
+
+			var maxTokensDist *tokenDist
+			if spec := c.String("max-tokens-dist"); spec != "" {
+				d, err := parseTokenDist(spec)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				maxTokensDist = &d
+			}
+
+			var influx *bufio.Writer
+			if path := c.String("influx-file"); path != "" {
+				f, err := os.Create(path)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error creating influx file: %v", err), 1)
+				}
+				defer f.Close()
+				influx = bufio.NewWriter(f)
+			}
+
+			var jsonl *jsonlWriter
+			if path := c.String("jsonl"); path != "" {
+				f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error opening jsonl file: %v", err), 1)
+				}
+				defer f.Close()
+				jsonl = &jsonlWriter{w: bufio.NewWriter(f)}
+			}
+
+			var runsCSV *csv.Writer
+			if path := c.String("csv"); path != "" {
+				f, err := os.Create(path)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error creating csv file: %v", err), 1)
+				}
+				defer f.Close()
+				runsCSV = csv.NewWriter(f)
+				runsCSV.Write(csvHeader(c.Bool("stream"), c.Int("turns") > 1))
+			}
+
+			turns := c.Int("turns")
+			if turns < 1 {
+				return cli.Exit("--turns must be at least 1", 1)
+			}
+			if turns > 1 && style == "grpc" {
+				return cli.Exit("--turns is not supported for the grpc style", 1)
+			}
+			think, err := parseThinkTime(c.String("think-time"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+
+			var tools json.RawMessage
+			if path := c.String("tools"); path != "" {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error reading tools file: %v", err), 1)
+				}
+				var defs []json.RawMessage
+				if err := json.Unmarshal(data, &defs); err != nil {
+					return cli.Exit(fmt.Sprintf("error parsing tools file: want a JSON array of tool definitions: %v", err), 1)
+				}
+				tools = json.RawMessage(data)
+			}
+
+			var custom *customStyle
+			if style == "custom" {
+				if c.Bool("stream") {
+					return cli.Exit("--stream is not supported for the custom style", 1)
+				}
+				custom, err = newCustomStyle(c.String("request-template"), c.String("content-path"), c.String("prompt-tokens-path"), c.String("completion-tokens-path"))
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+			}
+
+			endpoint := strings.ToLower(c.String("endpoint"))
+			switch endpoint {
+			case "chat":
+			case "completions":
+				if style != "openai" {
+					return cli.Exit("--endpoint completions is only supported for the openai style", 1)
+				}
+				if tools != nil {
+					return cli.Exit("--tools needs the chat endpoint", 1)
+				}
+			default:
+				return cli.Exit(fmt.Sprintf("invalid --endpoint %q: want chat or completions", c.String("endpoint")), 1)
+			}
+
+			prompt := c.String("prompt")
+			var dataset *promptDataset
+			if path := c.String("prompt-dataset"); path != "" {
+				if c.IsSet("prompt") || c.IsSet("prompt-file") {
+					return cli.Exit("--prompt-dataset is mutually exclusive with --prompt and --prompt-file", 1)
+				}
+				dataset, err = loadPromptDataset(path, c.String("prompt-sampling"))
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				infof("Prompts | %s from %s", dataset, path)
+			}
+			promptLengths := c.IntSlice("prompt-lengths")
+			if len(promptLengths) > 0 {
+				if c.IsSet("prompt") || c.IsSet("prompt-file") || dataset != nil {
+					return cli.Exit("--prompt-lengths synthesizes its own prompts and is mutually exclusive with --prompt, --prompt-file and --prompt-dataset", 1)
+				}
+				if len(c.IntSlice("concurrency-sweep")) > 0 {
+					return cli.Exit("--prompt-lengths and --concurrency-sweep are mutually exclusive", 1)
+				}
+				for _, length := range promptLengths {
+					if length <= 0 {
+						return cli.Exit("--prompt-lengths must be positive", 1)
+					}
+				}
+				// Warmup, preflight and --dry-run see the first length.
+				prompt = fillerPrompt(promptLengths[0])
+			}
+			if c.Bool("preflight") && c.Int("expect-status") != 0 && c.Int("expect-status") != http.StatusOK {
+				return cli.Exit("--preflight expects a 200 and can't be combined with --expect-status", 1)
+			}
+			if c.IsSet("timeseries-dir") && !c.Bool("stream") {
+				return cli.Exit("--timeseries-dir needs --stream", 1)
+			}
+			if c.IsSet("run-label") && c.String("sqlite") == "" {
+				return cli.Exit("--run-label needs --sqlite", 1)
+			}
+			if c.String("sqlite") != "" && (len(c.IntSlice("concurrency-sweep")) > 0 || len(promptLengths) > 0) {
+				return cli.Exit("--sqlite stores a single benchmark and can't be combined with --concurrency-sweep or --prompt-lengths", 1)
+			}
+			var maxTokensField string
+			if c.Bool("use-max-completion-tokens") {
+				maxTokensField = "max_completion_tokens"
+			}
+			thinkTags := c.String("think-tags")
+			if thinkTags != "" && thinkTags != "count" && thinkTags != "strip" {
+				return cli.Exit(fmt.Sprintf("invalid think-tags %q (expected count or strip)", thinkTags), 1)
+			}
+			if path := c.String("prompt-file"); path != "" {
+				if c.IsSet("prompt") {
+					return cli.Exit("--prompt and --prompt-file are mutually exclusive", 1)
+				}
+				var data []byte
+				var err error
+				if path == "-" {
+					data, err = io.ReadAll(os.Stdin)
+				} else {
+					data, err = os.ReadFile(path)
+				}
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error reading prompt file: %v", err), 1)
+				}
+				prompt = string(data)
+			}
+
+			system := c.String("system")
+			if path := c.String("system-file"); path != "" {
+				if c.IsSet("system") {
+					return cli.Exit("--system and --system-file are mutually exclusive", 1)
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("error reading system prompt file: %v", err), 1)
+				}
+				system = string(data)
+			}
+
+			sampling := map[string]any{"temperature": c.Float64("temperature")}
+			for flag, field := range map[string]string{
+				"top-p":             "top_p",
+				"presence-penalty":  "presence_penalty",
+				"frequency-penalty": "frequency_penalty",
+			} {
+				if c.IsSet(flag) {
+					sampling[field] = c.Float64(flag)
+				}
+			}
+			prices, err := loadPricing(c.Float64("price-input"), c.Float64("price-output"),
+				c.IsSet("price-input") || c.IsSet("price-output"), c.String("pricing-file"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			if prices != nil {
+				for _, model := range models {
+					if _, ok := prices.price(model); !ok {
+						warnf("Warning: no price for model %q in the pricing file; its runs are not costed", model)
+					}
+				}
+			}
+
+			params, err := parseParams(*c.Generic("param").(*repeatedFlag))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+
+			cfg := &benchConfig{
+				Client:           client,
+				GRPC:             gc,
+				BaseURL:          c.String("base-url"),
+				Key:              apiKey,
+				Model:            models[0],
+				Models:           models,
+				Prompt:           prompt,
+				System:           system,
+				Dataset:          dataset,
+				Style:            style,
+				Endpoint:         endpoint,
+				Stream:           c.Bool("stream"),
+				DryRun:           dryRun,
+				ExpectContains:   c.String("expect-contains"),
+				MinCompletion:    c.Int("min-completion-tokens"),
+				ThinkTags:        thinkTags,
+				TimeseriesDir:    c.String("timeseries-dir"),
+				MaxTokens:        c.Int("max-tokens"),
+				MaxTokensField:   maxTokensField,
+				MaxTokensDist:    maxTokensDist,
+				ExpectStatus:     c.Int("expect-status"),
+				TPSMode:          tpsMode,
+				DataDir:          dataDir,
+				StoreData:        storeData,
+				FairnessInterval: c.Duration("fairness-interval"),
+				ServerTimeHeader: c.String("server-time-header"),
+				DeadlineHeader:   c.String("request-deadline-header"),
+				Retries:          c.Int("retries"),
+				RetryBackoff:     c.Duration("retry-backoff"),
+				RetryBudget:      newRetryBudget(c.Float64("retry-budget"), runs),
+				Duration:         duration,
+				RPS:              c.Float64("rps"),
+				Ramp:             ramp,
+				Turns:            turns,
+				FollowUp:         c.String("follow-up"),
+				ThinkTime:        think,
+				Tools:            tools,
+				Custom:           custom,
+				Sampling:         sampling,
+				Headers:          headers,
+				Pricing:          prices,
+				Params:           params,
+				Abort:            abortCtx,
+				KeepRuns:         outputFormat == "json" || c.String("sqlite") != "" || c.String("pushgateway") != "" || windowHi > 0 || ramp != nil || len(models) > 1,
+				WaveTolerance:    c.Duration("wave-tolerance"),
+			}
+			// Streaming runs without a client timeout; the stream watchdog
+			// enforces --timeout per request, next to the idle timeout.
+			if cfg.Stream {
+				cfg.StreamTimeout = c.Duration("timeout")
+				cfg.StreamIdleTimeout = c.Duration("stream-idle-timeout")
+			}
+
+			// A dry run builds the first run's request as it would be sent
+			// and prints it instead.
+			if hint := checkBaseURL(style, cfg.BaseURL); hint != "" {
+				warnf("Warning: %s", hint)
+			}
+			if dryRun {
+				maxTokens := cfg.MaxTokens
+				if cfg.MaxTokensDist != nil {
+					maxTokens = cfg.MaxTokensDist.draw(rng)
+				}
+				promptIndex := -1
+				if dataset != nil {
+					promptIndex = dataset.pick(1, rng)
+				}
+				if oauthTokenURL != "" {
+					fmt.Println("# Authorization is replaced with the OAuth2 access token when sent")
+				}
+				if signer != nil {
+					fmt.Println("# The request is signed with AWS SigV4 when sent")
+				}
+				callAPI(c.Context, 1, 0, cfg, maxTokens, promptIndex, cfg.openingMessages(promptIndex), nil, nil)
+				return nil
+			}
+			if c.Bool("preflight") {
+				if err := preflight(c.Context, cfg); err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				infof("Preflight | %d model(s) answered", len(models))
+			}
+			if c.Bool("preload") {
+				if style != "ollama" {
+					return cli.Exit("--preload is only supported for the ollama style", 1)
+				}
+				for _, model := range models {
+					load, elapsed, err := preloadModel(c.Context, client, cfg.BaseURL, model)
+					if err != nil {
+						return cli.Exit(err.Error(), 1)
+					}
+					infof("Preload | model=%s | load_duration=%s | elapsed=%s", model, load.Round(time.Millisecond), elapsed.Round(time.Millisecond))
+				}
+			}
+
+			var warmedUp int
+			var warmRuns []runMetrics
+			if warmup > 0 {
+				warmedUp, warmRuns = runWarmup(c.Context, cfg, rng, warmup, conc, c.Float64("retry-budget"))
+				if c.Context.Err() != nil {
+					return cli.Exit("interrupted during warmup", 130)
+				}
+			}
+
+			if levels, lengths := c.IntSlice("concurrency-sweep"), promptLengths; len(levels) > 0 || len(lengths) > 0 {
+				if len(lengths) > 0 {
+					err = runPromptLengths(c.Context, cfg, rng, runs, conc, lengths, c.String("sweep-csv"), outputFormat)
+				} else {
+					err = runSweep(c.Context, cfg, rng, runs, levels, c.String("sweep-csv"), outputFormat)
+				}
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				if style == "ollama" && c.Bool("unload-model") {
+					for _, model := range models {
+						if err := unloadModel(context.WithoutCancel(c.Context), client, cfg.BaseURL, model); err != nil {
+							return err
+						}
+					}
+				}
+				switch outputFormat {
+				case "json":
+					infof("Total time taken: %s", time.Duration(time.Since(start)).Round(time.Millisecond))
+				case "markdown":
+					fmt.Printf("\n_Total time taken: %s_\n", time.Duration(time.Since(start)).Round(time.Millisecond))
+				default:
+					fmt.Printf("Total time taken         : %s\n", time.Duration(time.Since(start)).Round(time.Millisecond))
+				}
+				if c.Context.Err() != nil {
+					return cli.Exit("interrupted; sweep covers completed levels only", 130)
+				}
+				return nil
+			}
+
+			var health *healthMonitor
+			if interval := c.Duration("healthcheck-interval"); interval > 0 {
+				health, err = newHealthMonitor(cfg.BaseURL, c.String("health-path"), apiKey, interval, tlsConfig)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				health.start(c.Context)
+			}
+
+			cfg.Errors = newErrorTracker()
+			cfg.Statuses = newStatusTracker()
+			if c.Bool("progress") && outputFormat != "json" && isTerminal(os.Stderr) {
+				cfg.Progress = newProgress(os.Stderr, runs, duration)
+				cfg.Progress.start(context.WithoutCancel(c.Context))
+			}
+			res := runBenchmark(c.Context, cfg, rng, runs, conc, func(m runMetrics) {
+				// Only the JSONL log has a field to mark a cancelled run by.
+				if jsonl != nil {
+					if err := jsonl.write(m); err != nil {
+						warnf("Warning: error writing jsonl file: %v", err)
+					}
+				}
+				if m.Cancelled {
+					return
+				}
+				if influx != nil {
+					influx.WriteString(influxLine(m, style))
+					if err := influx.Flush(); err != nil {
+						warnf("Warning: error writing influx file: %v", err)
+					}
+				}
+				if runsCSV != nil {
+					runsCSV.Write(csvRecord(m, turns > 1))
+				}
+			})
+			cfg.Progress.stop()
+			all, dispatchStart, tracker := res.Runs, res.Start, res.Tracker
+			// Without every run, the per-run views below (histogram, phases)
+			// are drawn from the aggregator's sample and say so.
+			if !cfg.KeepRuns {
+				all = res.Agg.sampled()
+			}
+			if duration > 0 {
+				runs = res.Dispatched
+			}
+			var unhealthy time.Duration
+			var outages, probes, failures int
+			if health != nil {
+				unhealthy, outages, probes, failures = health.stop()
+			}
+
+			// Retries, cost and goodput cover every run; the rest of the
+			// summary only the runs inside --measure-window.
+			overall := res.Agg.summary()
+			good := overall.Runs
+			measured, stats := all, overall
+			if windowHi > 0 {
+				measured = filterMeasureWindow(all, dispatchStart, time.Now(), windowLo, windowHi)
+				window := aggregator{waves: waveTracker{tolerance: cfg.WaveTolerance}}
+				for _, m := range measured {
+					window.add(m)
+				}
+				stats = window.summary()
+			}
+			n := stats.Runs
+
+			sum := &summaryTable{Title: "Summary"}
+			requests := res.Requests
+			sum.add("Successful calls", "%d / %d", good, requests)
+			if c.Context.Err() != nil {
+				if duration > 0 {
+					sum.add("Interrupted", "after dispatching %d runs", res.Dispatched)
+				} else {
+					sum.add("Interrupted", "after dispatching %d of %d runs", res.Dispatched, runs)
+				}
+			}
+			var dispatch *dispatchRate
+			if rps := c.Float64("rps"); rps > 0 {
+				dispatch = &dispatchRate{TargetRPS: rps}
+				if span := res.LastDispatch.Sub(res.Start).Seconds(); res.Dispatched > 1 && span > 0 {
+					dispatch.AchievedRPS = float64(res.Dispatched-1) / span
+				}
+				sum.add("Dispatch rate", "%.2f runs/s (target %.2f)", dispatch.AchievedRPS, rps)
+			}
+			// Wall time runs from the first dispatch to the last result, so it
+			// leaves out setup and warmup but counts the tail of slow requests.
+			wall := res.End.Sub(res.Start)
+			var achievedRPS float64
+			if wall > 0 {
+				achievedRPS = float64(good) / wall.Seconds()
+			}
+			sum.add("Achieved RPS", "%.2f (%d successful requests over %s)", achievedRPS, good, wall.Round(time.Millisecond))
+			if expect := c.Int("expect-status"); expect != 0 {
+				sum.add("Expected status", "%d (%d pass / %d fail)", expect, good, requests-good)
+			}
+			if overall.Retried > 0 {
+				sum.add("Retries", "%d (%d successful runs needed a retry)", overall.Retries, overall.Retried)
+			}
+			if skipped := cfg.RetryBudget.exhaustedCount(); skipped > 0 {
+				sum.add("Retry budget exhausted", "%d failures not retried", skipped)
+			}
+			if warmedUp > 0 {
+				sum.add("Warmup runs", "%d discarded", warmedUp)
+			}
+			if dataset != nil {
+				sum.add("Prompt dataset", "%s", dataset)
+			}
+			if style != "grpc" {
+				sum.add("Connection pool", "%s", describePool(transport))
+			}
+			if windowHi > 0 {
+				sum.add("Measure window", "%s (%d in window, %d excluded)", c.String("measure-window"), n, good-n)
+			}
+			if n > 0 {
+				sum.add("Avg completion tokens", "%.2f", float64(stats.CompletionTokens)/float64(n))
+				sum.add("Avg total tokens", "%.2f", float64(stats.TotalTokens)/float64(n))
+				// Every run weighs the same in these means, so short fast
+				// requests pull them up; aggregate throughput below is what
+				// the server delivered as a whole.
+				sum.add("Mean tok/s per request", "%.2f (%s)", stats.TokPerSec.Avg, tpsMode)
+				sum.add("Mean completion tok/s", "%.2f per request", stats.MeanCompletionTokPerSec)
+				sum.add("Mean total tok/s", "%.2f per request", stats.MeanTotalTokPerSec)
+				if stats.Unrated > 0 {
+					sum.add("Unrated runs", "%d (no completion tokens or too fast to time; left out of the tok/s figures)", stats.Unrated)
+				}
+				if len(stats.PromptTPSBases) > 0 {
+					sum.add("Mean prompt tok/s", "%.2f per request (prompt tokens / %s)", stats.MeanPromptTokPerSec, promptTPSBasisLabel(stats.PromptTPSBases))
+				}
+				sum.add("Total completion tokens", "%d", stats.CompletionTokens)
+				// Reasoning is billed as completion tokens but never shown,
+				// so a chatty chain of thought hides in the totals.
+				if stats.ReasoningTokens > 0 {
+					sum.add("Reasoning tokens", "%d (%.1f%% of completion tokens, avg %.2f over %d runs)",
+						stats.ReasoningTokens, 100*float64(stats.ReasoningTokens)/float64(stats.CompletionTokens),
+						float64(stats.ReasoningTokens)/float64(stats.ReasoningRuns), stats.ReasoningRuns)
+				}
+				sum.add("Total tokens", "%d", stats.TotalTokens)
+			}
+			var cost *float64
+			if cfg.Pricing != nil {
+				cost = &overall.CostUSD
+				if good > 0 {
+					sum.add("Cost", "$%.6f total, $%.6f avg per request", overall.CostUSD, overall.CostUSD/float64(good))
+				}
+			}
+			// Averages hide the tail that SLOs are written against.
+			if n >= 2 {
+				sum.add("Latency p50/p90/p95/p99", "%s ms%s", stats.Latency.percentiles(), stats.sampleNote())
+				sum.add("Tok/s p50/p90/p95/p99", "%s%s", stats.TokPerSec.percentiles(), stats.sampleNote())
+				if stats.TTFTRuns >= 2 {
+					sum.add("TTFT p50/p90/p95/p99", "%s ms (min %.2f, avg %.2f, max %.2f)%s", stats.TTFT.percentiles(), stats.TTFT.Min, stats.TTFT.Avg, stats.TTFT.Max, stats.sampleNote())
+				}
+				// A steady endpoint and a jittery one can share a mean.
+				sum.add("Latency stddev", "%.2f ms (CV %.2f)", stats.Latency.StdDev, stats.Latency.CV)
+				sum.add("Tok/s stddev", "%.2f (CV %.2f)", stats.TokPerSec.StdDev, stats.TokPerSec.CV)
+			} else if n == 1 {
+				sum.add("Latency p50/p90/p95/p99", "n/a (only 1 successful run)")
+				sum.add("Latency stddev", "n/a (only 1 successful run)")
+			}
+			// Goodput only counts tokens that were actually delivered to a
+			// user: failed runs produce none and empty completions are
+			// excluded, so it can fall well below raw throughput under load.
+			var goodput float64
+			if wall > 0 && c.Int("expect-status") == 0 {
+				delivered := overall.CompletionTokens
+				goodput = float64(overall.UsefulTokens) / wall.Seconds()
+				sum.add("Aggregate throughput", "%.2f completion tok/s (%d tokens / %s wall clock)",
+					float64(delivered)/wall.Seconds(), delivered, wall.Round(time.Millisecond))
+				sum.add("Goodput", "%.2f tok/s (%d failed, %d empty excluded)", goodput, requests-good, overall.Empty)
+			}
+			// Bytes next to tokens tell a bandwidth-bound endpoint from a
+			// compute-bound one.
+			if overall.RespBytes > 0 {
+				sum.add("Bytes sent", "%s total, %s avg per request", formatBytes(float64(overall.ReqBytes)), formatBytes(float64(overall.ReqBytes)/float64(good)))
+				sum.add("Bytes received", "%s total, %s avg per request", formatBytes(float64(overall.RespBytes)), formatBytes(float64(overall.RespBytes)/float64(good)))
+				if wall > 0 {
+					sum.add("Effective bandwidth", "%.3f MB/s (bytes sent and received / wall clock)", float64(overall.ReqBytes+overall.RespBytes)/1e6/wall.Seconds())
+				}
+			}
+			// A single average hides bimodal workloads where a few long
+			// answers dominate, so report the spread of the per-run ratio.
+			if stats.RatioRuns > 0 {
+				sum.add("Completion/prompt ratio", "p10 %.2f / p50 %.2f / p90 %.2f (%d runs)%s",
+					stats.RatioP10, stats.RatioP50, stats.RatioP90, stats.RatioRuns, stats.sampleNote())
+			}
+			if stats.SplitRuns > 0 {
+				sum.add("Avg prefill ms", "%.2f", stats.PrefillMs)
+				sum.add("Avg decode ms", "%.2f", stats.DecodeMs)
+			}
+			// Ollama says how long it spent loading the model, so cold
+			// starts can be told apart from slow generation.
+			if stats.OllamaTimedRuns > 0 {
+				server := stats.LoadMs + stats.PromptEvalMs + stats.EvalMs
+				sum.add("Model load", "avg %.2f ms, max %.2f ms (%.1f%% of server time over %d runs)",
+					stats.LoadMs, stats.MaxLoadMs, 100*stats.LoadMs/server, stats.OllamaTimedRuns)
+				sum.add("Generation", "avg prompt eval %.2f ms, eval %.2f ms (%.1f%% of server time)",
+					stats.PromptEvalMs, stats.EvalMs, 100*(stats.PromptEvalMs+stats.EvalMs)/server)
+			}
+			// Runs answered in a single chunk have no gaps and are left out.
+			if stats.ITLRuns > 0 {
+				sum.add("Inter-token latency", "mean %.2f ms, p95 %.2f ms (avg over %d runs; worst run p95 %.2f ms)",
+					stats.ITLMean.Avg, stats.ITLP95.Avg, stats.ITLRuns, stats.ITLP95.Max)
+			}
+			if stats.ServerTimedRuns > 0 {
+				sum.add("Avg server time ms", "%.2f (client latency %.2f, overhead %.2f over %d runs)",
+					stats.ServerTimeMs, stats.ServerLatencyMs, stats.ServerLatencyMs-stats.ServerTimeMs, stats.ServerTimedRuns)
+			}
+			// The first request on a connection pays for the TCP (and TLS)
+			// handshake; splitting new from reused connections shows how much
+			// pool warmth skews the latency figures.
+			if style != "grpc" && replayPath == "" {
+				if stats.NewConns > 0 {
+					sum.add("New connections", "%d (avg latency %.2f ms, avg connect %.2f ms)",
+						stats.NewConns, stats.NewLatencyMs, stats.ConnectMs)
+				}
+				if stats.ReusedConns > 0 {
+					sum.add("Reused connections", "%d (avg latency %.2f ms)", stats.ReusedConns, stats.ReusedLatencyMs)
+				}
+			}
+			// Providers nearing a rate limit sometimes slow responses down
+			// instead of returning 429. A negative correlation between the
+			// remaining quota and latency is the tell-tale sign.
+			if stats.QuotaRuns >= 3 {
+				verdict := "no soft throttling detected"
+				if stats.QuotaCorrelation <= -0.3 {
+					verdict = "latency rose as remaining quota fell"
+				}
+				sum.add("Rate-limit correlation", "r=%.2f over %d runs (%s)", stats.QuotaCorrelation, stats.QuotaRuns, verdict)
+			}
+			// Every turn resends the whole conversation, so latency rising
+			// from turn to turn is the cost of the growing context.
+			if turns > 1 {
+				for _, ts := range stats.Turns {
+					if ts.Runs > 0 && ts.Turn <= turns {
+						sum.add(fmt.Sprintf("Turn %d", ts.Turn), "avg latency %.2f ms, avg prompt tokens %.1f, avg completion tokens %.1f, %.2f tok/s (%d runs)",
+							ts.AvgLatencyMs, ts.AvgPromptTokens, ts.AvgCompletionTokens, ts.AvgTokPerSec, ts.Runs)
+					}
+				}
+			}
+			if fairness, samples := tracker.fairness(); samples > 0 {
+				sum.add("Stream fairness (Jain)", "%.3f (%d samples)", fairness, samples)
+			}
+			if stats.Waves > 0 {
+				sum.add("Avg intra-wave spread", "%s (%d waves)", stats.WaveSpread.Round(time.Microsecond), stats.Waves)
+			}
+			var healthJSON *healthSummary
+			if health != nil {
+				healthJSON = &healthSummary{
+					UnhealthyMs:  float64(unhealthy.Microseconds()) / 1e3,
+					Outages:      outages,
+					Probes:       probes,
+					FailedProbes: failures,
+				}
+				sum.add("Unhealthy time", "%s over %d outages (%d of %d probes failed)",
+					unhealthy.Round(time.Millisecond), outages, failures, probes)
+			}
+
+			var unloadErr error
+			if style == "ollama" && c.Bool("unload-model") {
+				for _, model := range models {
+					if err := unloadModel(context.WithoutCancel(c.Context), client, cfg.BaseURL, model); err != nil {
+						unloadErr = err
+					}
+				}
+			}
+			sum.add("Total elapsed time", "%s", stats.Elapsed)
+			sum.add("Total wall time", "%s", wall.Round(time.Millisecond))
+			sum.add("Total time taken", "%s", time.Duration(time.Since(start)).Round(time.Millisecond))
+			errs := cfg.Errors.breakdown()
+			statuses := cfg.Statuses.histogram()
+			var modelRows []modelSummary
+			if len(models) > 1 {
+				modelRows = newModelSummaries(models, res.ModelRequests, all, measured)
+			}
+			phases := newPhaseSummaries(warmRuns, all)
+			var windows []windowSummary
+			if ramp != nil {
+				windows = newWindowSummaries(all, res.Start, rampWindows, *ramp)
+			}
+			if outputFormat == "json" {
+				// The human summary moves to stderr so stdout is a single
+				// JSON document that can be piped into jq.
+				sum.write(os.Stderr, "text")
+				if modelRows != nil {
+					writeModelSummaries(os.Stderr, "text", modelRows)
+				}
+				if phases != nil {
+					writePhaseSummaries(os.Stderr, "text", phases, cfg.Stream, overall.sampleNote())
+				}
+				if windows != nil {
+					writeWindowSummaries(os.Stderr, "text", windows)
+				}
+				if len(statuses) > 0 {
+					writeStatusCodes(os.Stderr, "text", statuses)
+				}
+				if len(errs) > 0 {
+					writeErrors(os.Stderr, "text", errs)
+				}
+				var ttft *statSummary
+				if stats.TTFTRuns > 0 {
+					ttft = &stats.TTFT
+				}
+				if err := writeJSON(os.Stdout, jsonSummary{
+					SchemaVersion:    jsonSchemaVersion,
+					Requests:         requests,
+					Successful:       good,
+					Failed:           requests - good,
+					Interrupted:      c.Context.Err() != nil,
+					TPSMode:          tpsMode,
+					PromptTokens:     stats.PromptTokens,
+					CompletionTokens: stats.CompletionTokens,
+					TotalTokens:      stats.TotalTokens,
+					ReqBytes:         overall.ReqBytes,
+					RespBytes:        overall.RespBytes,
+					ElapsedMs:        float64(time.Since(start).Microseconds()) / 1e3,
+					WallMs:           float64(wall.Microseconds()) / 1e3,
+					AchievedRPS:      achievedRPS,
+					LatencyMs:        stats.Latency,
+					TokPerSec:        stats.TokPerSec,
+					TTFTMs:           ttft,
+					UnratedRuns:      stats.Unrated,
+					Retries:          overall.Retries,
+					RetriedRuns:      overall.Retried,
+					CostUSD:          cost,
+					GoodputTokPerSec: goodput,
+					EmptyRuns:        overall.Empty,
+					Dispatch:         dispatch,
+					Health:           healthJSON,
+					Models:           modelRows,
+					Phases:           phases,
+					Windows:          windows,
+					Turns:            stats.Turns,
+					StatusCodes:      statuses,
+					Errors:           errs,
+					Runs:             all,
+				}); err != nil {
+					return cli.Exit(fmt.Sprintf("error writing json summary: %v", err), 1)
+				}
+			} else {
+				sum.write(os.Stdout, outputFormat)
+				if !c.Bool("no-hist") {
+					latencies := make([]float64, 0, n)
+					for _, m := range measured {
+						latencies = append(latencies, m.LatencyMs)
+					}
+					writeHistogram(os.Stdout, outputFormat, "Latency histogram"+stats.sampleNote(), "ms", latencies, c.Int("hist-buckets"))
+				}
+				if modelRows != nil {
+					writeModelSummaries(os.Stdout, outputFormat, modelRows)
+				}
+				if phases != nil {
+					writePhaseSummaries(os.Stdout, outputFormat, phases, cfg.Stream, overall.sampleNote())
+				}
+				if windows != nil {
+					writeWindowSummaries(os.Stdout, outputFormat, windows)
+				}
+				if len(statuses) > 0 {
+					writeStatusCodes(os.Stdout, outputFormat, statuses)
+				}
+				if len(errs) > 0 {
+					writeErrors(os.Stdout, outputFormat, errs)
+				}
+			}
+
+			if runsCSV != nil {
+				runsCSV.Flush()
+				if err := runsCSV.Error(); err != nil {
+					return cli.Exit(fmt.Sprintf("error writing csv file: %v", err), 1)
+				}
+			}
+
+			if url := c.String("pushgateway"); url != "" {
+				var stats []pushStats
+				for _, ms := range newModelSummaries(models, res.ModelRequests, all, measured) {
+					st := pushStats{Model: ms.Model, Requests: ms.Requests, Errors: ms.Requests - ms.Successful}
+					var tokens int
+					for _, m := range all {
+						if m.Model == ms.Model {
+							tokens += m.CompletionTokens
+						}
+					}
+					for _, m := range measured {
+						if m.Model == ms.Model {
+							st.LatenciesMs = append(st.LatenciesMs, m.LatencyMs)
+						}
+					}
+					if wall > 0 {
+						st.AggTokPerSec = float64(tokens) / wall.Seconds()
+					}
+					stats = append(stats, st)
+				}
+				if err := pushSummary(url, style, stats); err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				infof("Pushgateway | pushed summary to %s", url)
+			}
+
+			if path := c.String("sqlite"); path != "" {
+				id, err := storeSQLite(context.WithoutCancel(c.Context), path, sqliteBenchmark{
+					Label:       c.String("run-label"),
+					StartedAt:   dispatchStart,
+					Style:       style,
+					BaseURL:     cfg.BaseURL,
+					Models:      models,
+					Stream:      cfg.Stream,
+					TPSMode:     tpsMode,
+					Requests:    requests,
+					Interrupted: c.Context.Err() != nil,
+					Wall:        wall,
+					AchievedRPS: achievedRPS,
+					Stats:       stats,
+				}, all)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				infof("SQLite | benchmark %d with %d runs stored in %s", id, len(all), path)
+			}
+
+			if c.Context.Err() != nil {
+				return cli.Exit("interrupted; summary covers completed runs only", 130)
+			}
+			return unloadErr
+		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	// The first Ctrl+C stops dispatching new runs and lets the in-flight
+	// ones finish so the summary covers them. The second cancels the
+	// requests still in flight, whose streams report the tokens received so
+	// far; restoring the default handler then lets a third abort immediately.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		<-signals
+		stop()
+		<-signals
+		abortRequests(errors.New("interrupted again"))
+		signal.Stop(signals)
+	}()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
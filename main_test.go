@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// serveBody starts a server that answers every request with body.
+func serveBody(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testConfig is the smallest benchConfig callAPI runs with.
+func testConfig(baseURL, style string, stream bool) *benchConfig {
+	return &benchConfig{
+		Client:  &http.Client{},
+		BaseURL: baseURL,
+		Style:   style,
+		Stream:  stream,
+		Model:   "test-model",
+		TPSMode: "completion",
+	}
+}
+
+// callOnce sends one run with prompt and returns the metrics callAPI
+// reported, whether it reported any, and whether the run succeeded.
+func callOnce(t *testing.T, ctx context.Context, cfg *benchConfig, prompt string) (runMetrics, bool, bool) {
+	t.Helper()
+	ch := make(chan runMetrics, 1)
+	_, ok := callAPI(ctx, 1, 0, cfg, 64, -1, []chatMessage{{Role: "user", Content: prompt}}, ch, nil)
+	select {
+	case m := <-ch:
+		return m, true, ok
+	default:
+		return runMetrics{}, false, ok
+	}
+}
+
+func TestStreamTotalTokens(t *testing.T) {
+	tests := []struct {
+		name                      string
+		style                     string
+		body                      string
+		prompt, completion, total int
+	}{
+		{
+			name:  "openai usage chunk",
+			style: "openai",
+			body: "data: {\"choices\":[{\"delta\":{\"content\":\"hello there\"}}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":11,\"completion_tokens\":4,\"total_tokens\":15}}\n\n" +
+				"data: [DONE]\n\n",
+			prompt: 11, completion: 4, total: 15,
+		},
+		{
+			name:  "openai estimate",
+			style: "openai",
+			body: "data: {\"choices\":[{\"delta\":{\"content\":\"one two \"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"three\"}}]}\n\n" +
+				"data: [DONE]\n\n",
+			prompt: 3, completion: 3, total: 6,
+		},
+		{
+			name:  "ollama counts",
+			style: "ollama",
+			body: "{\"message\":{\"content\":\"hi\"},\"done\":false}\n" +
+				"{\"message\":{\"content\":\"\"},\"done\":true,\"done_reason\":\"stop\",\"prompt_eval_count\":7,\"eval_count\":5}\n",
+			prompt: 7, completion: 5, total: 12,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serveBody(t, tt.body)
+			m, sent, ok := callOnce(t, context.Background(), testConfig(srv.URL, tt.style, true), "a short prompt")
+			if !ok || !sent {
+				t.Fatalf("run failed")
+			}
+			if m.PromptTokens != tt.prompt || m.CompletionTokens != tt.completion || m.TotalTokens != tt.total {
+				t.Errorf("tokens = %d + %d = %d, want %d + %d = %d",
+					m.PromptTokens, m.CompletionTokens, m.TotalTokens, tt.prompt, tt.completion, tt.total)
+			}
+			if m.TotalTokens != m.PromptTokens+m.CompletionTokens {
+				t.Errorf("total %d != prompt %d + completion %d", m.TotalTokens, m.PromptTokens, m.CompletionTokens)
+			}
+		})
+	}
+}
+
+func TestSSEData(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   string
+		isData bool
+	}{
+		{`data: {"a":1}`, `{"a":1}`, true},
+		{`data:{"a":1}`, `{"a":1}`, true},
+		{"data: [DONE]", "[DONE]", true},
+		{"data:  two spaces", " two spaces", true},
+		{"event: message_start", "", false},
+		{"id: 42", "", false},
+		{"retry: 1000", "", false},
+		{": keep-alive", "", false},
+		{`{"message":{"content":"hi"}}`, `{"message":{"content":"hi"}}`, true},
+	}
+	for _, tt := range tests {
+		got, ok := sseData(tt.line)
+		if got != tt.want || ok != tt.isData {
+			t.Errorf("sseData(%q) = %q, %v; want %q, %v", tt.line, got, ok, tt.want, tt.isData)
+		}
+	}
+}
+
+func TestOpenAIStreamCountsSSEContent(t *testing.T) {
+	body := ": comment\n\n" +
+		"event: chunk\n" +
+		"data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n" +
+		"data:{\"choices\":[{\"delta\":{\"content\":\"alpha beta \"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"gamma\"},\"finish_reason\":\"stop\"}]}\n\n" +
+		"data: [DONE]\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"after done\"}}]}\n\n"
+	srv := serveBody(t, body)
+	m, sent, ok := callOnce(t, context.Background(), testConfig(srv.URL, "openai", true), "prompt")
+	if !ok || !sent {
+		t.Fatal("run failed")
+	}
+	if m.CompletionTokens != 3 {
+		t.Errorf("completion tokens = %d, want 3 (alpha beta gamma)", m.CompletionTokens)
+	}
+	if m.TTFTMs <= 0 {
+		t.Errorf("TTFT = %v, want > 0", m.TTFTMs)
+	}
+}
+
+func TestRetryBackoffStopsOnCancel(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := testConfig(srv.URL, "openai", false)
+	cfg.Retries, cfg.RetryBackoff = 5, time.Hour
+	cfg.Errors = newErrorTracker()
+	cfg.RetryBudget = newRetryBudget(1, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	began := time.Now()
+	_, sent, ok := callOnce(t, ctx, cfg, "prompt")
+	if ok || sent {
+		t.Fatalf("cancelled run reported success")
+	}
+	if waited := time.Since(began); waited > 5*time.Second {
+		t.Errorf("callAPI kept waiting %s after cancellation", waited)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("server saw %d attempts, want 1", n)
+	}
+	// Only the retry that was waiting when the run was cancelled.
+	if left := cfg.RetryBudget.remaining; left != 9 {
+		t.Errorf("retry budget has %d left, want 9", left)
+	}
+	if errs := cfg.Errors.breakdown(); len(errs) != 1 || errs[0].Category != "cancelled" {
+		t.Errorf("errors = %+v, want one cancelled", errs)
+	}
+}
+
+func TestStreamStoresResponseOnce(t *testing.T) {
+	var body strings.Builder
+	var want strings.Builder
+	for i := range 200 {
+		word := fmt.Sprintf("w%d ", i)
+		want.WriteString(word)
+		fmt.Fprintf(&body, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", word)
+	}
+	body.WriteString("data: [DONE]\n\n")
+	srv := serveBody(t, body.String())
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+
+	cfg := testConfig(srv.URL, "openai", true)
+	cfg.DataDir, cfg.StoreData = filepath.Join(t.TempDir(), "runs"), true
+	if _, _, ok := callOnce(t, context.Background(), cfg, "prompt"); !ok {
+		t.Fatal("run failed")
+	}
+	if n := strings.Count(logs.String(), "| response-stored |"); n != 1 {
+		t.Errorf("response stored %d times, want once", n)
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.DataDir, "001.response.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want.String() {
+		t.Errorf("stored response has %d bytes, want the whole %d-byte reply", len(got), want.Len())
+	}
+}
+
+func TestPersistRun(t *testing.T) {
+	tests := []struct {
+		name              string
+		turn              int
+		response, metrics string
+	}{
+		{"single turn", 0, "007.response.txt", "007.metrics.txt"},
+		{"first turn", 1, "007.response.txt", "007.metrics.txt"},
+		{"later turn", 3, "007.turn3.response.txt", "007.turn3.metrics.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The directory doesn't exist yet; persistRun creates it.
+			dir := filepath.Join(t.TempDir(), "nested", "runs")
+			m := runMetrics{Run: 7, Turn: tt.turn, Model: "m", CompletionTokens: 12, LatencyMs: 250}
+			persistRun(dir, 7, tt.turn, "the reply", m)
+
+			got, err := os.ReadFile(filepath.Join(dir, tt.response))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "the reply" {
+				t.Errorf("response = %q", got)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, tt.metrics))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stored runMetrics
+			if err := json.Unmarshal(data, &stored); err != nil {
+				t.Fatal(err)
+			}
+			if stored.Run != 7 || stored.Turn != tt.turn || stored.CompletionTokens != 12 || stored.LatencyMs != 250 {
+				t.Errorf("metrics = %+v", stored)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+				t.Errorf("%d files stored, want 2", len(entries))
+			}
+		})
+	}
+}
+
+func TestStoreRunDataReportsFilename(t *testing.T) {
+	dir := t.TempDir()
+	filename, err := storeRunData(dir, 12, "raw", "body")
+	if err != nil || filename != filepath.Join(dir, "012.raw.txt") {
+		t.Errorf("storeRunData = %q, %v", filename, err)
+	}
+	// A file where the directory should be can't be written through.
+	blocker := filepath.Join(dir, "blocker")
+	os.WriteFile(blocker, nil, 0644)
+	if filename, err := storeRunData(blocker, 1, "raw", "body"); err == nil {
+		t.Errorf("storeRunData into a file = %q, nil; want an error", filename)
+	}
+}
+
+// chunkReader hands out its input a few bytes at a time, so lines arrive
+// split across reads the way a slow stream delivers them.
+type chunkReader struct {
+	data string
+	size int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.data == "" {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), c.size)], c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestLineReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		lines []string
+	}{
+		{"terminated", "{\"a\":1}\n{\"b\":2}\n", []string{"{\"a\":1}\n", "{\"b\":2}\n"}},
+		{"unterminated last line", "{\"a\":1}\n{\"done\":true}", []string{"{\"a\":1}\n", "{\"done\":true}"}},
+		{"blank lines kept", "data: x\n\ndata: y\n", []string{"data: x\n", "\n", "data: y\n"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		for _, size := range []int{1, 3, 7, 4096} {
+			t.Run(fmt.Sprintf("%s/%d-byte reads", tt.name, size), func(t *testing.T) {
+				// A 16-byte buffer is the smallest bufio allows; with short
+				// reads it makes lines span several buffer fills too.
+				reader := &lineReader{r: bufio.NewReaderSize(&chunkReader{tt.input, size}, 16)}
+				var got []string
+				for {
+					line, err := reader.next()
+					if err != nil {
+						if err != io.EOF {
+							t.Fatalf("error %v, want io.EOF", err)
+						}
+						break
+					}
+					got = append(got, line)
+				}
+				if !slices.Equal(got, tt.lines) {
+					t.Errorf("lines = %q, want %q", got, tt.lines)
+				}
+				if _, err := reader.next(); err != io.EOF {
+					t.Errorf("after EOF: %v, want io.EOF again", err)
+				}
+			})
+		}
+	}
+}
+
+// serveChunks streams parts as separate flushed writes.
+func serveChunks(t *testing.T, parts ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		for _, part := range parts {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamSplitAndMalformedLines(t *testing.T) {
+	tests := []struct {
+		name       string
+		style      string
+		parts      []string
+		completion int
+		malformed  string // stream-malformed fields logged, "" for none
+	}{
+		{
+			name:  "ollama lines split mid-json, last unterminated",
+			style: "ollama",
+			parts: []string{
+				`{"message":{"con`, `tent":"one "},"done":false}` + "\n{\"mess",
+				`age":{"content":"two"},"done":false}` + "\n",
+				`{"message":{"content":""},"done":true,"prompt_eval_count":4,"eval_count":2}`,
+			},
+			completion: 2,
+		},
+		{
+			name:  "ollama malformed lines counted",
+			style: "ollama",
+			parts: []string{
+				"{\"message\":{\"content\":\"one\"},\"done\":false}\n",
+				"{not json\n",
+				"<html>proxy error</html>\n",
+				`{"message":{"content":""},"done":true,"eval_count":1}`,
+			},
+			completion: 1,
+			malformed:  "example={not json | lines=2",
+		},
+		{
+			name:  "openai event split across reads",
+			style: "openai",
+			parts: []string{
+				"data: {\"choices\":[{\"del", "ta\":{\"content\":\"alpha beta\"}}]}\n",
+				"\ndata: {\"choices\":[{\"delta\":{\"content\":\" gamma\"}}]}\n\nda",
+				"ta: [DONE]",
+			},
+			completion: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(io.Discard)
+
+			srv := serveChunks(t, tt.parts...)
+			m, sent, ok := callOnce(t, context.Background(), testConfig(srv.URL, tt.style, true), "prompt")
+			if !ok || !sent {
+				t.Fatalf("run failed: %s", logs.String())
+			}
+			if m.CompletionTokens != tt.completion {
+				t.Errorf("completion tokens = %d, want %d", m.CompletionTokens, tt.completion)
+			}
+			var logged string
+			for line := range strings.Lines(logs.String()) {
+				if _, fields, ok := strings.Cut(line, "| stream-malformed | "); ok {
+					logged = strings.TrimSpace(fields)
+				}
+			}
+			if logged != tt.malformed {
+				t.Errorf("stream-malformed %q, want %q", logged, tt.malformed)
+			}
+		})
+	}
+}
+
+func TestAbortCancelsStreamMidway(t *testing.T) {
+	sent := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		for _, word := range []string{"one ", "two ", "three "} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", word)
+		}
+		w.(http.Flusher).Flush()
+		close(sent)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	abortCtx, abort := context.WithCancelCause(context.Background())
+	cfg := testConfig(srv.URL, "openai", true)
+	cfg.Abort = abortCtx
+	cfg.Errors = newErrorTracker()
+	ctx, stopDispatch := context.WithCancel(context.Background())
+	go func() {
+		<-sent
+		// Like a first Ctrl+C: the stream in flight carries on.
+		stopDispatch()
+		time.Sleep(50 * time.Millisecond)
+		abort(errors.New("interrupted again"))
+	}()
+
+	var results []runMetrics
+	res := runBenchmark(ctx, cfg, rand.New(rand.NewSource(1)), 1, 1, func(m runMetrics) {
+		results = append(results, m)
+	})
+	if len(results) != 1 {
+		t.Fatalf("%d results, want the cancelled run", len(results))
+	}
+	m := results[0]
+	if !m.Cancelled || m.CompletionTokens != 3 || m.TotalTokens != m.PromptTokens+3 || m.TTFTMs <= 0 {
+		t.Errorf("metrics = %+v, want cancelled with 3 partial tokens", m)
+	}
+	if s := res.Agg.summary(); s.Runs != 0 {
+		t.Errorf("summary counts %d successful runs, want none", s.Runs)
+	}
+	errs := cfg.Errors.breakdown()
+	if len(errs) != 1 || errs[0].Category != "cancelled" || !strings.Contains(errs[0].Example, "interrupted again") {
+		t.Errorf("errors = %+v, want one cancelled", errs)
+	}
+}
+
+func TestInterruptedSessionCountsSentTurns(t *testing.T) {
+	srv := serveChunks(t,
+		"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n",
+		"data: [DONE]\n\n",
+	)
+	cfg := testConfig(srv.URL, "openai", true)
+	cfg.Turns = 3
+	cfg.ThinkTime = thinkTime{min: time.Minute, max: time.Minute}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// Interrupt during the think time after the first turn: the two turns
+	// never sent must not count as requests.
+	res := runBenchmark(ctx, cfg, rand.New(rand.NewSource(1)), 1, 1, func(runMetrics) { stop() })
+	if res.Requests != 1 || res.ModelRequests["test-model"] != 1 {
+		t.Errorf("requests = %d (%v), want the one turn sent", res.Requests, res.ModelRequests)
+	}
+	if s := res.Agg.summary(); s.Runs != 1 {
+		t.Errorf("summary counts %d successful runs, want 1", s.Runs)
+	}
+}
+
+func TestPerSecond(t *testing.T) {
+	tests := []struct {
+		n, secs float64
+		rate    float64
+		ok      bool
+	}{
+		{10, 2, 5, true},
+		{0, 0, 0, true}, // nothing to count needs no time
+		{0, 1, 0, true},
+		{10, 0, 0, false},
+		{10, -1, 0, false},
+		{10, 1e-320, 0, false}, // overflows to +Inf
+		{math.NaN(), 1, 0, false},
+	}
+	for _, tt := range tests {
+		rate, ok := perSecond(tt.n, tt.secs)
+		if rate != tt.rate || ok != tt.ok {
+			t.Errorf("perSecond(%v, %v) = %v, %v; want %v, %v", tt.n, tt.secs, rate, ok, tt.rate, tt.ok)
+		}
+	}
+}
+
+func TestSetRates(t *testing.T) {
+	tests := []struct {
+		name                   string
+		m                      runMetrics
+		mode                   string
+		completion, total, tps float64
+		prompt                 float64
+		basis                  string
+		undefined              bool
+	}{
+		{
+			name:       "non-stream",
+			m:          runMetrics{PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150, LatencyMs: 500},
+			mode:       "completion",
+			completion: 100, total: 300, tps: 100, prompt: 200, basis: "latency",
+		},
+		{
+			name:       "stream decodes after ttft",
+			m:          runMetrics{PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150, LatencyMs: 1000, TTFTMs: 500, DecodeMs: 500},
+			mode:       "total",
+			completion: 100, total: 150, tps: 150, prompt: 200, basis: "ttft",
+		},
+		{
+			name:       "ollama timings",
+			m:          runMetrics{PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30, LatencyMs: 1000, DecodeMs: 400, PromptEvalDurationMs: 100},
+			mode:       "completion",
+			completion: 50, total: 30, tps: 50, prompt: 100, basis: "prompt_eval",
+		},
+		{
+			name:      "zero tokens",
+			m:         runMetrics{LatencyMs: 250},
+			mode:      "completion",
+			basis:     "latency",
+			undefined: true,
+		},
+		{
+			name:  "prompt but no completion tokens",
+			m:     runMetrics{PromptTokens: 10, TotalTokens: 10, LatencyMs: 500},
+			mode:  "total",
+			total: 20, tps: 20, prompt: 20, basis: "latency",
+			undefined: true,
+		},
+		{
+			name:      "zero duration",
+			m:         runMetrics{PromptTokens: 5, CompletionTokens: 3, TotalTokens: 8},
+			mode:      "completion",
+			basis:     "latency",
+			undefined: true,
+		},
+		{
+			name:      "zero duration and zero tokens",
+			m:         runMetrics{},
+			mode:      "completion",
+			basis:     "latency",
+			undefined: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			m.setRates(tt.mode)
+			if !approx(m.CompletionTokPerSec, tt.completion) || !approx(m.TotalTokPerSec, tt.total) ||
+				!approx(m.TokPerSec, tt.tps) || !approx(m.PromptTokPerSec, tt.prompt) {
+				t.Errorf("completion %v total %v tok/s %v prompt %v; want %v %v %v %v",
+					m.CompletionTokPerSec, m.TotalTokPerSec, m.TokPerSec, m.PromptTokPerSec,
+					tt.completion, tt.total, tt.tps, tt.prompt)
+			}
+			if m.PromptTPSBasis != tt.basis || m.RateUndefined != tt.undefined {
+				t.Errorf("basis %q undefined %v, want %q %v", m.PromptTPSBasis, m.RateUndefined, tt.basis, tt.undefined)
+			}
+			if _, err := json.Marshal(m); err != nil {
+				t.Errorf("metrics don't encode: %v", err)
+			}
+		})
+	}
+}
+
+func TestZeroTokenReplyIsUnrated(t *testing.T) {
+	srv := serveBody(t, `{"choices":[{"message":{"content":""}}],"usage":{"prompt_tokens":4,"completion_tokens":0,"total_tokens":4}}`)
+	m, sent, ok := callOnce(t, context.Background(), testConfig(srv.URL, "openai", false), "prompt")
+	if !ok || !sent {
+		t.Fatal("run failed")
+	}
+	if m.CompletionTokens != 0 || m.CompletionTokPerSec != 0 || !m.RateUndefined {
+		t.Errorf("metrics = %+v, want 0 completion tok/s flagged rate_undefined", m)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// preflightMaxTokens keeps the preflight request cheap; it only has to
+// prove that the endpoint answers.
+const preflightMaxTokens = 16
+
+// checkBaseURL looks for the base URL mistakes that otherwise only show up
+// as 404s from every run: a style pointed at another API's root, or a base
+// URL that already ends in the path the style appends. It returns a hint,
+// or "" when nothing looks off.
+func checkBaseURL(style, baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("--base-url %q is not an absolute URL (e.g. http://localhost:11434/api)", baseURL)
+	}
+	path := strings.TrimRight(u.Path, "/")
+	switch style {
+	case "ollama":
+		switch {
+		case strings.HasSuffix(path, "/chat"):
+			return fmt.Sprintf("--base-url %q already ends in /chat, which --style ollama appends; use the /api root", baseURL)
+		case strings.HasSuffix(path, "/v1"):
+			return fmt.Sprintf("--base-url %q looks like an OpenAI-compatible root; Ollama's native API is under /api (e.g. http://localhost:11434/api), or use --style openai for its /v1", baseURL)
+		case !strings.HasSuffix(path, "/api"):
+			return fmt.Sprintf("--style ollama posts to {base-url}/chat, so --base-url %q usually needs to end in /api", baseURL)
+		}
+	case "openai", "anthropic", "cohere":
+		if u.Port() == "11434" && !strings.HasSuffix(path, "/v1") {
+			return fmt.Sprintf("port 11434 is Ollama's; use --style ollama with %s://%s/api, or %s://%s/v1 for its OpenAI-compatible API", u.Scheme, u.Host, u.Scheme, u.Host)
+		}
+		for _, suffix := range []string{"/chat/completions", "/completions", "/messages", "/chat"} {
+			if strings.HasSuffix(path, suffix) {
+				return fmt.Sprintf("--base-url %q already ends in %s; give the API root (e.g. .../v1), the style appends the endpoint", baseURL, suffix)
+			}
+		}
+		if style == "openai" && strings.HasSuffix(path, "/api") {
+			return fmt.Sprintf("--base-url %q looks like Ollama's native API; use --style ollama, or the /v1 root for its OpenAI-compatible API", baseURL)
+		}
+	}
+	return ""
+}
+
+// preflight sends one short request per model before the benchmark, so a
+// wrong base URL, key or model fails at once with the server's answer
+// instead of once per run. Reply checks, storage and retries are left out;
+// they belong to the measured runs.
+func preflight(ctx context.Context, cfg *benchConfig) error {
+	pre := *cfg
+	pre.Errors = newErrorTracker()
+	pre.Statuses = nil
+	pre.Progress = nil
+	pre.StoreData = false
+	pre.TimeseriesDir = ""
+	pre.ExpectContains = ""
+	pre.MinCompletion = 0
+	pre.Retries = 0
+	pre.Turns = 1
+	for _, model := range cfg.Models {
+		pre.Model = model
+		ch := make(chan runMetrics, 1)
+		var ok bool
+		if pre.Style == "grpc" {
+			ok = callGRPC(ctx, 0, &pre, preflightMaxTokens, -1, ch)
+		} else {
+			_, ok = callAPI(ctx, 0, 0, &pre, preflightMaxTokens, -1, pre.openingMessages(-1), ch, nil)
+		}
+		if ok {
+			continue
+		}
+		msg := fmt.Sprintf("preflight request for model %q failed", model)
+		if errs := pre.Errors.breakdown(); len(errs) > 0 {
+			msg += fmt.Sprintf(" (%s): %s", errs[0].Category, errs[0].Example)
+		}
+		if hint := checkBaseURL(pre.Style, pre.BaseURL); hint != "" {
+			msg += "\nhint: " + hint
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
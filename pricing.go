@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// modelPrice is what a model charges in USD per million tokens.
+type modelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// pricing prices runs for --price-input/--price-output and --pricing-file.
+// Models listed in the file use their own prices; any other model falls
+// back to the flag prices when they were given.
+type pricing struct {
+	fallback *modelPrice
+	models   map[string]modelPrice
+}
+
+// loadPricing returns nil when no prices were configured. The pricing file
+// is a JSON object mapping model names to {"input": N, "output": N}.
+func loadPricing(input, output float64, flagsSet bool, path string) (*pricing, error) {
+	if !flagsSet && path == "" {
+		return nil, nil
+	}
+	if input < 0 || output < 0 {
+		return nil, fmt.Errorf("--price-input and --price-output must not be negative")
+	}
+	p := &pricing{}
+	if flagsSet {
+		p.fallback = &modelPrice{Input: input, Output: output}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading pricing file: %w", err)
+		}
+		if err := json.Unmarshal(data, &p.models); err != nil {
+			return nil, fmt.Errorf("error parsing pricing file: want {\"model\": {\"input\": N, \"output\": N}}: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *pricing) price(model string) (modelPrice, bool) {
+	if mp, ok := p.models[model]; ok {
+		return mp, true
+	}
+	if p.fallback != nil {
+		return *p.fallback, true
+	}
+	return modelPrice{}, false
+}
+
+// cost returns the USD cost of one run, or zero when its model has no
+// price.
+func (p *pricing) cost(m runMetrics) float64 {
+	if p == nil {
+		return 0
+	}
+	mp, ok := p.price(m.Model)
+	if !ok {
+		return 0
+	}
+	return (float64(m.PromptTokens)*mp.Input + float64(m.CompletionTokens)*mp.Output) / 1e6
+}
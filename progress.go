@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressWindow is how far back the rolling tokens/sec looks.
+const progressWindow = 5 * time.Second
+
+// progress keeps a single status line at the bottom of the terminal with
+// completed runs, success and error counts and a rolling tokens/sec. Log
+// lines are routed through it so they print above the status line rather
+// than over it.
+type progress struct {
+	out      io.Writer
+	total    int           // 0 in --duration mode
+	duration time.Duration // set in --duration mode
+
+	mu      sync.Mutex
+	began   time.Time
+	done    int
+	ok      int
+	failed  int
+	samples []tokenSample
+	line    string
+
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+type tokenSample struct {
+	at     time.Time
+	tokens int
+}
+
+// isTerminal reports whether f is a character device, which is as close as
+// the standard library gets to telling whether a person is watching.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(out io.Writer, total int, duration time.Duration) *progress {
+	return &progress{out: out, total: total, duration: duration}
+}
+
+// start begins redrawing the status line and takes over the log output
+// until stop is called.
+func (p *progress) start(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	p.began = time.Now()
+	log.SetOutput(p)
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.stopped = make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				p.redraw()
+				p.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// stop clears the status line and hands the log output back to stderr.
+func (p *progress) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.stopped
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	p.line = ""
+	log.SetOutput(os.Stderr)
+}
+
+// result records the tokens of one successful request.
+func (p *progress) result(m runMetrics) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.samples = append(p.samples, tokenSample{at: time.Now(), tokens: m.CompletionTokens})
+}
+
+// runDone records a finished run.
+func (p *progress) runDone(ok bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if ok {
+		p.ok++
+	} else {
+		p.failed++
+	}
+	p.redraw()
+}
+
+// Write prints a log line above the status line.
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw()
+	return n, err
+}
+
+func (p *progress) clear() {
+	if p.line != "" {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
+
+func (p *progress) draw() {
+	if p.line != "" {
+		fmt.Fprint(p.out, p.line)
+	}
+}
+
+// redraw recomputes the status line and replaces the one on screen.
+func (p *progress) redraw() {
+	now := time.Now()
+	cutoff := now.Add(-progressWindow)
+	i := 0
+	for i < len(p.samples) && p.samples[i].at.Before(cutoff) {
+		i++
+	}
+	p.samples = p.samples[i:]
+	var tokens int
+	for _, s := range p.samples {
+		tokens += s.tokens
+	}
+	window := min(now.Sub(p.began), progressWindow).Seconds()
+
+	var b strings.Builder
+	b.WriteString("Progress | ")
+	switch {
+	case p.total > 0:
+		fmt.Fprintf(&b, "%d/%d runs", p.done, p.total)
+	case p.duration > 0:
+		fmt.Fprintf(&b, "%d runs, %s/%s", p.done, now.Sub(p.began).Round(time.Second), p.duration)
+	default:
+		fmt.Fprintf(&b, "%d runs", p.done)
+	}
+	fmt.Fprintf(&b, " | %d ok, %d failed", p.ok, p.failed)
+	if window > 0 {
+		fmt.Fprintf(&b, " | %.1f tok/s", float64(tokens)/window)
+	}
+
+	p.clear()
+	p.line = b.String()
+	p.draw()
+}
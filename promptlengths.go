@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// promptFiller is repeated to pad a synthesized prompt to its length. It's
+// plain prose so no tokenizer treats it as anything unusual.
+const promptFiller = "The committee reviewed the quarterly report and noted that shipping times had improved in every region except the north. "
+
+// fillerPrompt builds a prompt of roughly the given number of tokens, as
+// counted by the active --tokenizer: a short instruction followed by as many
+// copies of promptFiller as it takes.
+func fillerPrompt(tokens int) string {
+	const ask = "Summarize the following notes in one sentence.\n\n"
+	var b strings.Builder
+	b.WriteString(ask)
+	per := max(countTokens(promptFiller), 1)
+	for n := countTokens(ask); n < tokens; n += per {
+		b.WriteString(promptFiller)
+	}
+	return b.String()
+}
+
+// runPromptLengths runs the benchmark once per prompt length with a
+// synthesized prompt of that size and prints how latency and prefill speed
+// scale with it, optionally also as CSV.
+func runPromptLengths(ctx context.Context, cfg *benchConfig, rng *rand.Rand, runs, conc int, lengths []int, csvPath, outputFormat string) error {
+	var csvw *csv.Writer
+	if csvPath != "" {
+		f, err := os.Create(csvPath)
+		if err != nil {
+			return fmt.Errorf("error creating sweep csv: %w", err)
+		}
+		defer f.Close()
+		csvw = csv.NewWriter(f)
+		csvw.Write([]string{"prompt_length", "runs", "successful", "avg_prompt_tokens", "avg_latency_ms", "p95_latency_ms", "avg_ttft_ms", "prompt_tok_per_sec", "completion_tok_per_sec"})
+	}
+
+	type row struct {
+		length, good, requests             int
+		promptTokens, avgLat, p95Lat, ttft float64
+		promptTPS, completionTPS           float64
+	}
+	var rows []row
+	for _, length := range lengths {
+		if ctx.Err() != nil {
+			break
+		}
+		cfg.Prompt = fillerPrompt(length)
+		infof("Prompt length | target=%d | tokens=%d (%s)", length, countTokens(cfg.Prompt), activeTokenizer)
+		res := runBenchmark(ctx, cfg, rng, runs, conc, nil)
+
+		stats := res.Agg.summary()
+		r := row{length: length, good: stats.Runs, requests: res.Requests}
+		if r.good > 0 {
+			r.promptTokens = float64(stats.PromptTokens) / float64(r.good)
+			r.avgLat, r.p95Lat = stats.Latency.Avg, stats.Latency.P95
+			r.ttft = stats.TTFT.Avg
+			r.promptTPS = stats.MeanPromptTokPerSec
+			r.completionTPS = stats.MeanCompletionTokPerSec
+		}
+		rows = append(rows, r)
+
+		if csvw != nil {
+			csvw.Write([]string{
+				strconv.Itoa(r.length), strconv.Itoa(r.requests), strconv.Itoa(r.good),
+				strconv.FormatFloat(r.promptTokens, 'f', 2, 64),
+				strconv.FormatFloat(r.avgLat, 'f', 2, 64),
+				strconv.FormatFloat(r.p95Lat, 'f', 2, 64),
+				strconv.FormatFloat(r.ttft, 'f', 2, 64),
+				strconv.FormatFloat(r.promptTPS, 'f', 2, 64),
+				strconv.FormatFloat(r.completionTPS, 'f', 2, 64),
+			})
+		}
+	}
+
+	switch outputFormat {
+	case "json":
+		type level struct {
+			PromptLength        int     `json:"prompt_length"`
+			Requests            int     `json:"requests"`
+			Successful          int     `json:"successful"`
+			AvgPromptTokens     float64 `json:"avg_prompt_tokens"`
+			AvgLatencyMs        float64 `json:"avg_latency_ms"`
+			P95LatencyMs        float64 `json:"p95_latency_ms"`
+			AvgTTFTMs           float64 `json:"avg_ttft_ms,omitempty"`
+			PromptTokPerSec     float64 `json:"prompt_tok_per_sec"`
+			CompletionTokPerSec float64 `json:"completion_tok_per_sec"`
+		}
+		levels := make([]level, len(rows))
+		for i, r := range rows {
+			levels[i] = level{r.length, r.requests, r.good, r.promptTokens, r.avgLat, r.p95Lat, r.ttft, r.promptTPS, r.completionTPS}
+		}
+		if err := writeJSON(os.Stdout, map[string]any{"prompt_lengths": levels}); err != nil {
+			return fmt.Errorf("error writing json prompt lengths: %w", err)
+		}
+	case "markdown":
+		fmt.Printf("\n### Prompt lengths\n\n")
+		cells := make([][]string, len(rows))
+		for i, r := range rows {
+			cells[i] = []string{
+				strconv.Itoa(r.length), fmt.Sprintf("%d/%d", r.good, r.requests), fmt.Sprintf("%.0f", r.promptTokens),
+				fmt.Sprintf("%.2f", r.avgLat), fmt.Sprintf("%.2f", r.p95Lat), fmt.Sprintf("%.2f", r.ttft),
+				fmt.Sprintf("%.2f", r.promptTPS), fmt.Sprintf("%.2f", r.completionTPS),
+			}
+		}
+		writeMarkdownTable(os.Stdout, []string{"Prompt length", "Successful", "Prompt tokens", "Avg latency ms", "p95 latency ms", "Avg TTFT ms", "Prompt tok/s", "Completion tok/s"}, cells)
+	default:
+		fmt.Printf("\n=== Prompt lengths ===\n")
+		fmt.Printf("%13s  %10s  %13s  %14s  %14s  %11s  %12s  %16s\n", "Prompt length", "Successful", "Prompt tokens", "Avg latency ms", "p95 latency ms", "Avg TTFT ms", "Prompt tok/s", "Completion tok/s")
+		for _, r := range rows {
+			fmt.Printf("%13d  %10s  %13.0f  %14.2f  %14.2f  %11.2f  %12.2f  %16.2f\n", r.length, fmt.Sprintf("%d/%d", r.good, r.requests), r.promptTokens, r.avgLat, r.p95Lat, r.ttft, r.promptTPS, r.completionTPS)
+		}
+	}
+
+	if csvw != nil {
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			return fmt.Errorf("error writing sweep csv: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushStats is one model's share of a run, as pushed to the gateway.
+type pushStats struct {
+	Model        string
+	Requests     int
+	Errors       int
+	LatenciesMs  []float64 // successful runs
+	AggTokPerSec float64
+}
+
+var pushQuantiles = []float64{50, 90, 95, 99}
+
+// pushSummary sends the run's summary to a Prometheus pushgateway under job
+// "llmbench", replacing what the previous run pushed. Every series carries
+// model and style labels; latency goes out both as quantile gauges matching
+// the summary and as a histogram that can be aggregated across runs.
+func pushSummary(url, style string, stats []pushStats) error {
+	labels := []string{"model", "style"}
+	requests := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "llmbench_requests",
+		Help: "Requests sent in the last benchmark run.",
+	}, labels)
+	errs := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "llmbench_errors",
+		Help: "Requests that failed in the last benchmark run.",
+	}, labels)
+	quantiles := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "llmbench_latency_quantile_seconds",
+		Help: "Request latency quantiles of the last benchmark run.",
+	}, append(labels, "quantile"))
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "llmbench_latency_seconds",
+		Help:    "Request latency of the last benchmark run.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, labels)
+	tps := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "llmbench_throughput_tokens_per_second",
+		Help: "Aggregate completion tokens per second of wall-clock time in the last benchmark run.",
+	}, labels)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(requests, errs, quantiles, latency, tps)
+
+	for _, s := range stats {
+		requests.WithLabelValues(s.Model, style).Set(float64(s.Requests))
+		errs.WithLabelValues(s.Model, style).Set(float64(s.Errors))
+		tps.WithLabelValues(s.Model, style).Set(s.AggTokPerSec)
+		if len(s.LatenciesMs) == 0 {
+			continue
+		}
+		sorted := make([]float64, len(s.LatenciesMs))
+		copy(sorted, s.LatenciesMs)
+		sort.Float64s(sorted)
+		for _, q := range pushQuantiles {
+			quantiles.WithLabelValues(s.Model, style, strconv.FormatFloat(q/100, 'f', -1, 64)).Set(percentile(sorted, q) / 1e3)
+		}
+		h := latency.WithLabelValues(s.Model, style)
+		for _, ms := range sorted {
+			h.Observe(ms / 1e3)
+		}
+	}
+
+	if err := push.New(url, "llmbench").Gatherer(reg).Push(); err != nil {
+		return fmt.Errorf("error pushing metrics to %s: %w", url, err)
+	}
+	return nil
+}
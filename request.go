@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// requestOptions is everything besides the style, endpoint, key and model
+// that shapes a request.
+type requestOptions struct {
+	Endpoint  string // OpenAI style: "chat" or "completions"
+	Stream    bool
+	MaxTokens int
+	Tools     json.RawMessage
+	Sampling  map[string]any // OpenAI field names; mapped for Gemini
+	Params    map[string]any // merged into the body last
+	Headers   http.Header    // --header values, applied last
+
+	// MaxTokensField names the OpenAI chat limit: max_tokens when empty, or
+	// max_completion_tokens, which o1 and later models require.
+	MaxTokensField string
+	// Custom renders the body for --style custom.
+	Custom *customStyle
+}
+
+// buildRequest builds the POST a style expects for one turn of a
+// conversation. The body can be re-read through GetBody, so the request
+// can be cloned for every retry.
+func buildRequest(style, baseURL, key, model string, messages []chatMessage, opts requestOptions) (*http.Request, error) {
+	var endpoint string
+	var payload map[string]any
+	switch style {
+	case "ollama":
+		endpoint = strings.TrimRight(baseURL, "/") + "/chat"
+		payload = map[string]any{
+			"model":    model,
+			"messages": messages,
+			"stream":   opts.Stream,
+			"options":  map[string]any{"num_predict": opts.MaxTokens},
+		}
+	case "anthropic":
+		endpoint = strings.TrimRight(baseURL, "/") + "/messages"
+		// Anthropic takes the system prompt as a top-level field rather
+		// than as a message.
+		turns := messages
+		if len(turns) > 0 && turns[0].Role == "system" {
+			turns = turns[1:]
+		}
+		payload = map[string]any{
+			"model":      model,
+			"messages":   turns,
+			"max_tokens": opts.MaxTokens,
+			"stream":     opts.Stream,
+		}
+		if len(turns) < len(messages) {
+			payload["system"] = messages[0].Content
+		}
+	case "gemini":
+		// The key travels as a query parameter; alt=sse makes the streaming
+		// method answer with Server-Sent Events instead of a JSON array.
+		method, query := ":generateContent", url.Values{"key": {key}}
+		if opts.Stream {
+			method = ":streamGenerateContent"
+			query.Set("alt", "sse")
+		}
+		endpoint = strings.TrimRight(baseURL, "/") + "/models/" + url.PathEscape(model) + method + "?" + query.Encode()
+		payload = geminiPayload(messages, opts.MaxTokens, opts.Sampling)
+	case "cohere":
+		endpoint = strings.TrimRight(baseURL, "/") + "/chat"
+		payload = coherePayload(model, messages, opts.MaxTokens, opts.Stream, opts.Sampling)
+	case "bedrock":
+		// Model IDs carry a ":" before the version, which InvokeModel wants
+		// percent-encoded like any other reserved character.
+		id := strings.ReplaceAll(url.PathEscape(model), ":", "%3A")
+		endpoint = strings.TrimRight(baseURL, "/") + "/model/" + id + "/invoke"
+		var err error
+		payload, err = bedrockPayload(model, messages, opts.MaxTokens, opts.Sampling)
+		if err != nil {
+			return nil, err
+		}
+	case "custom":
+		// A custom API's path can be anything, so the base URL is used as
+		// given.
+		endpoint = baseURL
+		var err error
+		payload, err = opts.Custom.payload(model, messages, opts.MaxTokens, opts.Stream, opts.Sampling)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		endpoint = strings.TrimRight(baseURL, "/") + "/chat/completions"
+		payload = map[string]any{
+			"model":      model,
+			"messages":   messages,
+			"max_tokens": opts.MaxTokens,
+			"stream":     opts.Stream,
+		}
+		// The legacy completions endpoint takes raw text, which lets base
+		// models without a chat template be benchmarked.
+		if opts.Endpoint == "completions" {
+			endpoint = strings.TrimRight(baseURL, "/") + "/completions"
+			delete(payload, "messages")
+			payload["prompt"] = completionPrompt(messages)
+		} else if opts.MaxTokensField != "" {
+			delete(payload, "max_tokens")
+			payload[opts.MaxTokensField] = opts.MaxTokens
+		}
+		maps.Copy(payload, opts.Sampling)
+		// Ask for a final usage chunk so streamed runs report the server's
+		// token counts instead of an estimate.
+		if opts.Stream {
+			payload["stream_options"] = map[string]any{"include_usage": true}
+		}
+	}
+	if opts.Tools != nil {
+		payload["tools"] = opts.Tools
+	}
+	mergeParams(payload, opts.Params)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request body: %w", err)
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthHeaders(req, style, key)
+	setExtraHeaders(req, opts.Headers)
+	return req, nil
+}
+
+// mergeParams copies the --param fields into payload. An object given for a
+// field the body already holds as an object, such as Ollama's options or
+// Gemini's generationConfig, is merged into it key by key, so
+// --param options={"temperature":0} keeps the num_predict set from
+// --max-tokens; anything else replaces the field.
+func mergeParams(payload, params map[string]any) {
+	for k, v := range params {
+		extra, isObject := v.(map[string]any)
+		existing, hasObject := payload[k].(map[string]any)
+		if isObject && hasObject {
+			merged := maps.Clone(existing)
+			maps.Copy(merged, extra)
+			payload[k] = merged
+			continue
+		}
+		payload[k] = v
+	}
+}
+
+// completionPrompt flattens the conversation into the single prompt string
+// the completions endpoint takes.
+func completionPrompt(messages []chatMessage) string {
+	parts := make([]string, len(messages))
+	for i, msg := range messages {
+		parts[i] = msg.Content
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// geminiPayload builds a generateContent body. Gemini calls the assistant
+// "model" and takes the system prompt as systemInstruction; --max-tokens
+// and the sampling flags go in generationConfig under their camelCase names.
+func geminiPayload(messages []chatMessage, maxTokens int, sampling map[string]any) map[string]any {
+	payload := map[string]any{}
+	contents := make([]map[string]any, 0, len(messages))
+	for _, msg := range messages {
+		part := []map[string]string{{"text": msg.Content}}
+		switch msg.Role {
+		case "system":
+			payload["systemInstruction"] = map[string]any{"parts": part}
+			continue
+		case "assistant":
+			contents = append(contents, map[string]any{"role": "model", "parts": part})
+		default:
+			contents = append(contents, map[string]any{"role": msg.Role, "parts": part})
+		}
+	}
+	payload["contents"] = contents
+
+	config := map[string]any{"maxOutputTokens": maxTokens}
+	for field, name := range map[string]string{
+		"temperature":       "temperature",
+		"top_p":             "topP",
+		"presence_penalty":  "presencePenalty",
+		"frequency_penalty": "frequencyPenalty",
+	} {
+		if v, ok := sampling[field]; ok {
+			config[name] = v
+		}
+	}
+	payload["generationConfig"] = config
+	return payload
+}
+
+// coherePayload builds a Cohere v1 chat body. The API takes the latest
+// message on its own, earlier turns as chat_history under Cohere's role
+// names and the system prompt as preamble.
+func coherePayload(model string, messages []chatMessage, maxTokens int, stream bool, sampling map[string]any) map[string]any {
+	payload := map[string]any{
+		"model":      model,
+		"max_tokens": maxTokens,
+		"stream":     stream,
+	}
+	var history []map[string]string
+	for i, msg := range messages {
+		switch {
+		case msg.Role == "system":
+			payload["preamble"] = msg.Content
+		case i == len(messages)-1:
+			payload["message"] = msg.Content
+		case msg.Role == "assistant":
+			history = append(history, map[string]string{"role": "CHATBOT", "message": msg.Content})
+		default:
+			history = append(history, map[string]string{"role": "USER", "message": msg.Content})
+		}
+	}
+	if len(history) > 0 {
+		payload["chat_history"] = history
+	}
+	for field, name := range map[string]string{
+		"temperature":       "temperature",
+		"top_p":             "p",
+		"presence_penalty":  "presence_penalty",
+		"frequency_penalty": "frequency_penalty",
+	} {
+		if v, ok := sampling[field]; ok {
+			payload[name] = v
+		}
+	}
+	return payload
+}
+
+// bedrockAnthropicVersion is the Messages API version Bedrock expects in
+// the body of Claude requests.
+const bedrockAnthropicVersion = "bedrock-2023-05-31"
+
+// bedrockModelIDs maps short names accepted by --model to Bedrock model IDs.
+// Anything else is sent as given, so full IDs and inference profiles work.
+var bedrockModelIDs = map[string]string{
+	"claude-3-haiku":     "anthropic.claude-3-haiku-20240307-v1:0",
+	"claude-3-sonnet":    "anthropic.claude-3-sonnet-20240229-v1:0",
+	"claude-3-opus":      "anthropic.claude-3-opus-20240229-v1:0",
+	"claude-3-5-haiku":   "anthropic.claude-3-5-haiku-20241022-v1:0",
+	"claude-3-5-sonnet":  "anthropic.claude-3-5-sonnet-20240620-v1:0",
+	"titan-text-lite":    "amazon.titan-text-lite-v1",
+	"titan-text-express": "amazon.titan-text-express-v1",
+	"titan-text-premier": "amazon.titan-text-premier-v1:0",
+}
+
+func bedrockModelID(model string) string {
+	if id, ok := bedrockModelIDs[model]; ok {
+		return id
+	}
+	return model
+}
+
+// bedrockFamily names the body format a Bedrock model takes: "anthropic"
+// for Claude, "titan" for Titan Text, or "" for models not supported.
+// Inference profiles prefix the ID with a geography, such as "us.".
+func bedrockFamily(model string) string {
+	switch {
+	case strings.Contains(model, "anthropic.claude"):
+		return "anthropic"
+	case strings.Contains(model, "amazon.titan-text"):
+		return "titan"
+	}
+	return ""
+}
+
+// bedrockPayload builds an InvokeModel body in the model family's own
+// format: Anthropic's Messages API for Claude and a single inputText for
+// Titan, which has no notion of turns.
+func bedrockPayload(model string, messages []chatMessage, maxTokens int, sampling map[string]any) (map[string]any, error) {
+	switch bedrockFamily(model) {
+	case "anthropic":
+		turns := messages
+		if len(turns) > 0 && turns[0].Role == "system" {
+			turns = turns[1:]
+		}
+		payload := map[string]any{
+			"anthropic_version": bedrockAnthropicVersion,
+			"messages":          turns,
+			"max_tokens":        maxTokens,
+		}
+		if len(turns) < len(messages) {
+			payload["system"] = messages[0].Content
+		}
+		for _, field := range []string{"temperature", "top_p"} {
+			if v, ok := sampling[field]; ok {
+				payload[field] = v
+			}
+		}
+		return payload, nil
+	case "titan":
+		config := map[string]any{"maxTokenCount": maxTokens}
+		for field, name := range map[string]string{"temperature": "temperature", "top_p": "topP"} {
+			if v, ok := sampling[field]; ok {
+				config[name] = v
+			}
+		}
+		return map[string]any{
+			"inputText":            completionPrompt(messages),
+			"textGenerationConfig": config,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported Bedrock model %q: want an Anthropic Claude or Amazon Titan Text model ID", model)
+}
+
+// apiResponse is a non-streamed reply reduced to what the metrics need.
+type apiResponse struct {
+	Content string
+	// Usage holds the server's token counts, zero where it sent none.
+	Usage usageBlock
+	// Ollama's server-side timings in nanoseconds; zero for other styles.
+	LoadDuration       int64
+	PromptEvalDuration int64
+	EvalDuration       int64
+}
+
+// apiError is an error the API reported in a well-formed body, as opposed
+// to a body that could not be parsed.
+type apiError struct {
+	Message string
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+// parseResponse decodes a non-streamed reply of the given style. Errors are
+// an *apiError when the server described the failure itself.
+func parseResponse(style string, raw []byte) (apiResponse, error) {
+	if i := bytes.IndexByte(raw, '{'); i >= 0 {
+		raw = raw[i:]
+	}
+
+	switch style {
+	case "ollama":
+		var or ollamaResp
+		if err := json.Unmarshal(raw, &or); err != nil {
+			return apiResponse{}, err
+		}
+		return apiResponse{
+			Content: or.Message.Content,
+			Usage: usageBlock{
+				PromptTokens:     or.PromptEvalCount,
+				CompletionTokens: or.EvalCount,
+				TotalTokens:      or.PromptEvalCount + or.EvalCount,
+			},
+			LoadDuration:       or.LoadDuration,
+			PromptEvalDuration: or.PromptEvalDuration,
+			EvalDuration:       or.EvalDuration,
+		}, nil
+	case "anthropic":
+		var ar anthropicResp
+		if err := json.Unmarshal(raw, &ar); err != nil {
+			return apiResponse{}, err
+		}
+		if ar.Type == "error" {
+			return apiResponse{}, &apiError{Message: ar.Error.Message}
+		}
+		var content strings.Builder
+		for _, block := range ar.Content {
+			content.WriteString(block.Text)
+		}
+		return apiResponse{
+			Content: content.String(),
+			Usage: usageBlock{
+				PromptTokens:     ar.Usage.InputTokens,
+				CompletionTokens: ar.Usage.OutputTokens,
+				TotalTokens:      ar.Usage.InputTokens + ar.Usage.OutputTokens,
+			},
+		}, nil
+	case "gemini":
+		var gr geminiResp
+		if err := json.Unmarshal(raw, &gr); err != nil {
+			return apiResponse{}, err
+		}
+		// Thinking models bill thoughtsTokenCount on top; like the other
+		// styles, only the visible completion is counted.
+		return apiResponse{
+			Content: gr.text(),
+			Usage: usageBlock{
+				PromptTokens:     gr.UsageMetadata.PromptTokenCount,
+				CompletionTokens: gr.UsageMetadata.CandidatesTokenCount,
+				TotalTokens:      gr.UsageMetadata.PromptTokenCount + gr.UsageMetadata.CandidatesTokenCount,
+			},
+		}, nil
+	case "cohere":
+		var cr cohereResp
+		if err := json.Unmarshal(raw, &cr); err != nil {
+			return apiResponse{}, err
+		}
+		if cr.Text == "" && cr.Message != "" {
+			return apiResponse{}, &apiError{Message: cr.Message}
+		}
+		return apiResponse{Content: cr.Text, Usage: cr.usage()}, nil
+	case "bedrock":
+		var br bedrockResp
+		if err := json.Unmarshal(raw, &br); err != nil {
+			return apiResponse{}, err
+		}
+		if br.Type == "error" {
+			return apiResponse{}, &apiError{Message: br.Error.Message}
+		}
+		// Claude replies in the Messages format, Titan with a list of
+		// results.
+		if len(br.Results) > 0 {
+			var content strings.Builder
+			completion := 0
+			for _, r := range br.Results {
+				content.WriteString(r.OutputText)
+				completion += r.TokenCount
+			}
+			return apiResponse{
+				Content: content.String(),
+				Usage: usageBlock{
+					PromptTokens:     br.InputTextTokenCount,
+					CompletionTokens: completion,
+					TotalTokens:      br.InputTextTokenCount + completion,
+				},
+			}, nil
+		}
+		var content strings.Builder
+		for _, block := range br.Content {
+			content.WriteString(block.Text)
+		}
+		return apiResponse{
+			Content: content.String(),
+			Usage: usageBlock{
+				PromptTokens:     br.Usage.InputTokens,
+				CompletionTokens: br.Usage.OutputTokens,
+				TotalTokens:      br.Usage.InputTokens + br.Usage.OutputTokens,
+			},
+		}, nil
+	default:
+		var ok successResp
+		if err := json.Unmarshal(raw, &ok); err != nil {
+			var apiErr errorResp
+			if json.Unmarshal(raw, &apiErr) == nil && apiErr.Error != "" {
+				return apiResponse{}, &apiError{Message: apiErr.Error}
+			}
+			return apiResponse{}, err
+		}
+		var content string
+		if len(ok.Choices) > 0 {
+			// Completions replies carry text instead of a message.
+			content = ok.Choices[0].Message.Content
+			if content == "" {
+				content = ok.Choices[0].Text
+			}
+		}
+		return apiResponse{Content: content, Usage: ok.Usage}, nil
+	}
+}
+
+// streamDelta is what one line of a streamed reply adds to the response.
+type streamDelta struct {
+	// Content is the next piece of the reply's text.
+	Content string
+	// Output reports that the line carried generated text or tool-call
+	// text; those lines time the first token and the gaps between tokens.
+	Output bool
+	// ToolCalls are calls that start on this line: whole ones from Ollama,
+	// Anthropic tool_use blocks whose arguments follow.
+	ToolCalls []streamToolCall
+	// Arguments extends the latest tool call (Anthropic's partial_json).
+	Arguments string
+	// ToolDeltas are OpenAI delta.tool_calls fragments, merged by index.
+	ToolDeltas []any
+	// Usage holds the token counts the line reports, zero where it reports
+	// none; mergeUsage folds it into the counts so far.
+	Usage *usageBlock
+	// Ollama is the final line of an Ollama stream, with its timings.
+	Ollama *ollamaResp
+	// Done reports that the stream ends with this line.
+	Done bool
+}
+
+// appendToolCalls applies the tool-call parts of d to the calls so far.
+func (d streamDelta) appendToolCalls(calls []streamToolCall) []streamToolCall {
+	calls = append(calls, d.ToolCalls...)
+	if d.Arguments != "" && len(calls) > 0 {
+		calls[len(calls)-1].Arguments += d.Arguments
+	}
+	if len(d.ToolDeltas) > 0 {
+		calls, _ = appendToolCallDeltas(calls, d.ToolDeltas)
+	}
+	return calls
+}
+
+// parseStreamChunk decodes one line of a streamed reply of the given style,
+// already stripped of its SSE framing. A line that isn't JSON, or doesn't
+// fit the style's schema, is an error; events a style doesn't use carry
+// nothing.
+func parseStreamChunk(style, line string) (streamDelta, error) {
+	// OpenAI terminates the stream with a single "[DONE]" message.
+	if line == "[DONE]" {
+		return streamDelta{Done: true}, nil
+	}
+	if style == "ollama" && strings.Contains(line, `"done_reason"`) {
+		var meta ollamaResp
+		_ = json.Unmarshal([]byte(line), &meta)
+		return streamDelta{Ollama: &meta, Done: true}, nil
+	}
+
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+		return streamDelta{}, err
+	}
+	var d streamDelta
+	switch style {
+	case "ollama":
+		// { "message": { "content": "..." } }
+		msg, _ := chunk["message"].(map[string]any)
+		d.Content, _ = msg["content"].(string)
+		// Ollama sends each tool call whole rather than in fragments.
+		if calls, ok := msg["tool_calls"].([]any); ok {
+			d.ToolCalls = appendOllamaToolCalls(nil, calls)
+		}
+		d.Output = d.Content != "" || len(d.ToolCalls) > 0
+	case "gemini":
+		// Gemini streams whole responses, each carrying the next piece of
+		// text: { "candidates": [ { "content": { "parts": [ { "text": "..." } ] } } ] }
+		var gr geminiResp
+		if err := json.Unmarshal([]byte(line), &gr); err != nil {
+			return streamDelta{}, err
+		}
+		d.Content = gr.text()
+		d.Output = d.Content != ""
+		// usageMetadata is repeated in every chunk, the last one being final.
+		if u := gr.UsageMetadata; u.CandidatesTokenCount > 0 {
+			d.Usage = &usageBlock{
+				PromptTokens:     u.PromptTokenCount,
+				CompletionTokens: u.CandidatesTokenCount,
+				TotalTokens:      u.PromptTokenCount + u.CandidatesTokenCount,
+			}
+		}
+	case "cohere":
+		// Cohere streams JSON lines typed by event_type: each
+		// text-generation carries the next piece of text and stream-end the
+		// whole response, token counts included.
+		switch chunk["event_type"] {
+		case "text-generation":
+			d.Content, _ = chunk["text"].(string)
+			d.Output = d.Content != ""
+		case "stream-end":
+			var end struct {
+				Response cohereResp `json:"response"`
+			}
+			if json.Unmarshal([]byte(line), &end) == nil && end.Response.Meta.Tokens.OutputTokens > 0 {
+				usage := end.Response.usage()
+				d.Usage = &usage
+			}
+			d.Done = true
+		}
+	case "anthropic":
+		// Anthropic sends typed events; the "event:" lines carry no JSON
+		// and never get here, the type is repeated in the data. Usage comes
+		// in two parts: input tokens in message_start, output tokens in
+		// message_delta.
+		switch chunk["type"] {
+		case "message_start":
+			msg, _ := chunk["message"].(map[string]any)
+			usage, _ := msg["usage"].(map[string]any)
+			if n, ok := usage["input_tokens"].(float64); ok {
+				d.Usage = &usageBlock{PromptTokens: int(n)}
+			}
+		case "content_block_start":
+			if block, ok := chunk["content_block"].(map[string]any); ok && block["type"] == "tool_use" {
+				id, _ := block["id"].(string)
+				name, _ := block["name"].(string)
+				d.ToolCalls = []streamToolCall{{ID: id, Type: "tool_use", Name: name}}
+			}
+		case "content_block_delta":
+			delta, _ := chunk["delta"].(map[string]any)
+			d.Content, _ = delta["text"].(string)
+			d.Arguments, _ = delta["partial_json"].(string)
+			d.Output = d.Content != "" || d.Arguments != ""
+		case "message_delta":
+			usage, _ := chunk["usage"].(map[string]any)
+			if n, ok := usage["output_tokens"].(float64); ok {
+				d.Usage = &usageBlock{CompletionTokens: int(n)}
+			}
+		case "message_stop":
+			d.Done = true
+		}
+	default:
+		// OpenAI format: { "choices": [ { "delta": { "content": "..." }, "finish_reason": null } ] }
+		// Usage comes in a last chunk with no choices when asked for via
+		// stream_options.include_usage.
+		if u, ok := chunk["usage"].(map[string]any); ok {
+			var usage usageBlock
+			if data, err := json.Marshal(u); err == nil && json.Unmarshal(data, &usage) == nil {
+				d.Usage = &usage
+			}
+		}
+		if choices, ok := chunk["choices"].([]any); ok && len(choices) > 0 {
+			choice, _ := choices[0].(map[string]any)
+			// Completions: { "choices": [ { "text": "..." } ] }
+			text, _ := choice["text"].(string)
+			delta, _ := choice["delta"].(map[string]any)
+			content, _ := delta["content"].(string)
+			d.Content = text + content
+			d.ToolDeltas, _ = delta["tool_calls"].([]any)
+			// Whether a fragment carries text doesn't depend on the calls
+			// it will be merged into.
+			_, grew := appendToolCallDeltas(nil, d.ToolDeltas)
+			d.Output = d.Content != "" || grew
+		}
+	}
+	return d, nil
+}
+
+// mergeUsage folds the counts one stream line reports into those seen so
+// far. Fields the line leaves at zero keep their earlier value, since
+// Anthropic reports input and output tokens in separate events.
+func mergeUsage(u *usageBlock, next usageBlock) *usageBlock {
+	if u == nil {
+		u = &usageBlock{}
+	}
+	if next.PromptTokens > 0 {
+		u.PromptTokens = next.PromptTokens
+	}
+	if next.CompletionTokens > 0 {
+		u.CompletionTokens = next.CompletionTokens
+	}
+	if next.TotalTokens > 0 {
+		u.TotalTokens = next.TotalTokens
+	}
+	if n := next.CompletionTokensDetails.ReasoningTokens; n > 0 {
+		u.CompletionTokensDetails.ReasoningTokens = n
+	}
+	return u
+}
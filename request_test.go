@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// requestBody decodes the JSON body of req into its top-level fields, each
+// left encoded so it can be compared as text.
+func requestBody(t *testing.T, req *http.Request) map[string]json.RawMessage {
+	t.Helper()
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatalf("body %s: %v", data, err)
+	}
+	return body
+}
+
+func TestBuildRequest(t *testing.T) {
+	conversation := []chatMessage{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "hi"},
+	}
+	tests := []struct {
+		name    string
+		style   string
+		opts    requestOptions
+		url     string
+		headers map[string]string
+		fields  map[string]string // top-level body fields, JSON-encoded
+		absent  []string
+	}{
+		{
+			name:    "openai chat",
+			style:   "openai",
+			url:     "http://api.test/v1/chat/completions",
+			headers: map[string]string{"Authorization": "Bearer sk-test", "Content-Type": "application/json"},
+			fields: map[string]string{
+				"model":      `"m"`,
+				"max_tokens": "64",
+				"stream":     "false",
+				"messages":   `[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]`,
+			},
+			absent: []string{"stream_options"},
+		},
+		{
+			name:   "openai stream asks for usage",
+			style:  "openai",
+			opts:   requestOptions{Stream: true},
+			url:    "http://api.test/v1/chat/completions",
+			fields: map[string]string{"stream": "true", "stream_options": `{"include_usage":true}`},
+		},
+		{
+			name:   "openai max_completion_tokens",
+			style:  "openai",
+			opts:   requestOptions{MaxTokensField: "max_completion_tokens"},
+			url:    "http://api.test/v1/chat/completions",
+			fields: map[string]string{"max_completion_tokens": "64"},
+			absent: []string{"max_tokens"},
+		},
+		{
+			name:   "openai completions endpoint",
+			style:  "openai",
+			opts:   requestOptions{Endpoint: "completions"},
+			url:    "http://api.test/v1/completions",
+			fields: map[string]string{"prompt": `"be brief\n\nhi"`},
+			absent: []string{"messages"},
+		},
+		{
+			name:   "sampling and params",
+			style:  "openai",
+			opts:   requestOptions{Sampling: map[string]any{"temperature": 0.5, "top_p": 0.9}, Params: map[string]any{"temperature": 0.1, "seed": 7}},
+			url:    "http://api.test/v1/chat/completions",
+			fields: map[string]string{"temperature": "0.1", "top_p": "0.9", "seed": "7"},
+		},
+		{
+			name:    "ollama",
+			style:   "ollama",
+			url:     "http://api.test/v1/chat",
+			headers: map[string]string{"Authorization": ""},
+			fields:  map[string]string{"options": `{"num_predict":64}`, "stream": "false"},
+			absent:  []string{"max_tokens"},
+		},
+		{
+			name:   "ollama options param is merged",
+			style:  "ollama",
+			opts:   requestOptions{Params: map[string]any{"options": map[string]any{"temperature": 0, "num_ctx": 4096}}},
+			url:    "http://api.test/v1/chat",
+			fields: map[string]string{"options": `{"num_ctx":4096,"num_predict":64,"temperature":0}`},
+		},
+		{
+			name:   "ollama options param can override num_predict",
+			style:  "ollama",
+			opts:   requestOptions{Params: map[string]any{"options": map[string]any{"num_predict": 8}}},
+			url:    "http://api.test/v1/chat",
+			fields: map[string]string{"options": `{"num_predict":8}`},
+		},
+		{
+			name:   "gemini generationConfig param is merged",
+			style:  "gemini",
+			opts:   requestOptions{Params: map[string]any{"generationConfig": map[string]any{"topK": 5}}},
+			url:    "http://api.test/v1/models/m:generateContent?key=sk-test",
+			fields: map[string]string{"generationConfig": `{"maxOutputTokens":64,"topK":5}`},
+		},
+		{
+			name:   "non-object param replaces the field",
+			style:  "ollama",
+			opts:   requestOptions{Params: map[string]any{"options": "raw", "keep_alive": "5m"}},
+			url:    "http://api.test/v1/chat",
+			fields: map[string]string{"options": `"raw"`, "keep_alive": `"5m"`},
+		},
+		{
+			name:    "anthropic",
+			style:   "anthropic",
+			url:     "http://api.test/v1/messages",
+			headers: map[string]string{"x-api-key": "sk-test", "anthropic-version": anthropicVersion, "Authorization": ""},
+			fields: map[string]string{
+				"system":     `"be brief"`,
+				"messages":   `[{"role":"user","content":"hi"}]`,
+				"max_tokens": "64",
+			},
+		},
+		{
+			name:    "gemini stream",
+			style:   "gemini",
+			opts:    requestOptions{Stream: true},
+			url:     "http://api.test/v1/models/m:streamGenerateContent?alt=sse&key=sk-test",
+			headers: map[string]string{"Authorization": ""},
+			fields: map[string]string{
+				"systemInstruction": `{"parts":[{"text":"be brief"}]}`,
+				"contents":          `[{"parts":[{"text":"hi"}],"role":"user"}]`,
+				"generationConfig":  `{"maxOutputTokens":64}`,
+			},
+		},
+		{
+			name:   "cohere",
+			style:  "cohere",
+			url:    "http://api.test/v1/chat",
+			fields: map[string]string{"preamble": `"be brief"`, "message": `"hi"`, "max_tokens": "64"},
+			absent: []string{"chat_history"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.MaxTokens = 64
+			req, err := buildRequest(tt.style, "http://api.test/v1/", "sk-test", "m", conversation, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != "POST" || req.URL.String() != tt.url {
+				t.Errorf("%s %s, want POST %s", req.Method, req.URL, tt.url)
+			}
+			for name, want := range tt.headers {
+				if got := req.Header.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			body := requestBody(t, req)
+			for field, want := range tt.fields {
+				if got := string(body[field]); got != want {
+					t.Errorf("%s = %s, want %s", field, got, want)
+				}
+			}
+			for _, field := range tt.absent {
+				if got, ok := body[field]; ok {
+					t.Errorf("%s = %s, want it left out", field, got)
+				}
+			}
+		})
+	}
+}
+
+// Retries clone the request, so its body has to be readable again.
+func TestBuildRequestBodyRereadable(t *testing.T) {
+	req, err := buildRequest("openai", "http://api.test/v1", "k", "m", []chatMessage{{Role: "user", Content: "hi"}}, requestOptions{MaxTokens: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := io.ReadAll(req.Body)
+	again, err := req.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := io.ReadAll(again)
+	if len(first) == 0 || string(first) != string(second) || req.ContentLength != int64(len(first)) {
+		t.Errorf("body %q, reread %q, content length %d", first, second, req.ContentLength)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		style   string
+		raw     string
+		content string
+		usage   usageBlock
+	}{
+		{
+			name:    "openai chat",
+			style:   "openai",
+			raw:     `{"choices":[{"message":{"role":"assistant","content":"hello"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+			content: "hello",
+			usage:   usageBlock{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4},
+		},
+		{
+			name:    "openai completions",
+			style:   "openai",
+			raw:     `{"choices":[{"text":"once upon"}]}`,
+			content: "once upon",
+		},
+		{
+			name:    "leading garbage is skipped",
+			style:   "openai",
+			raw:     "\n\n  {\"choices\":[{\"message\":{\"content\":\"ok\"}}]}",
+			content: "ok",
+		},
+		{
+			name:    "ollama",
+			style:   "ollama",
+			raw:     `{"message":{"content":"hey"},"prompt_eval_count":5,"eval_count":2}`,
+			content: "hey",
+			usage:   usageBlock{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7},
+		},
+		{
+			name:    "anthropic",
+			style:   "anthropic",
+			raw:     `{"type":"message","content":[{"type":"text","text":"a"},{"type":"text","text":"b"}],"usage":{"input_tokens":9,"output_tokens":2}}`,
+			content: "ab",
+			usage:   usageBlock{PromptTokens: 9, CompletionTokens: 2, TotalTokens: 11},
+		},
+		{
+			name:    "gemini",
+			style:   "gemini",
+			raw:     `{"candidates":[{"content":{"parts":[{"text":"x"},{"text":"y"}]}}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":2,"totalTokenCount":6}}`,
+			content: "xy",
+			usage:   usageBlock{PromptTokens: 4, CompletionTokens: 2, TotalTokens: 6},
+		},
+		{
+			name:    "cohere",
+			style:   "cohere",
+			raw:     `{"text":"sure","meta":{"tokens":{"input_tokens":6,"output_tokens":1}}}`,
+			content: "sure",
+			usage:   usageBlock{PromptTokens: 6, CompletionTokens: 1, TotalTokens: 7},
+		},
+		{
+			name:    "bedrock titan",
+			style:   "bedrock",
+			raw:     `{"inputTextTokenCount":8,"results":[{"tokenCount":3,"outputText":"fine"}]}`,
+			content: "fine",
+			usage:   usageBlock{PromptTokens: 8, CompletionTokens: 3, TotalTokens: 11},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResponse(tt.style, []byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Content != tt.content || got.Usage != tt.usage {
+				t.Errorf("got %q %+v, want %q %+v", got.Content, got.Usage, tt.content, tt.usage)
+			}
+		})
+	}
+}
+
+func TestParseResponseErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		style    string
+		raw      string
+		apiError string // empty for a body that doesn't parse
+	}{
+		{"anthropic error", "anthropic", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, "Overloaded"},
+		{"cohere error", "cohere", `{"message":"invalid api token"}`, "invalid api token"},
+		{"not json", "ollama", `{"message":`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseResponse(tt.style, []byte(tt.raw))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			var apiErr *apiError
+			if isAPI := errors.As(err, &apiErr); isAPI != (tt.apiError != "") || (isAPI && apiErr.Message != tt.apiError) {
+				t.Errorf("error %v (%T), want API error %q", err, err, tt.apiError)
+			}
+		})
+	}
+}
+
+func TestParseStreamChunk(t *testing.T) {
+	tests := []struct {
+		name  string
+		style string
+		line  string
+		want  streamDelta
+	}{
+		{
+			name:  "openai delta",
+			style: "openai",
+			line:  `{"choices":[{"delta":{"content":"hi"},"finish_reason":null}]}`,
+			want:  streamDelta{Content: "hi", Output: true},
+		},
+		{
+			name:  "openai role-only delta",
+			style: "openai",
+			line:  `{"choices":[{"delta":{"role":"assistant","content":""}}]}`,
+		},
+		{
+			name:  "openai completions text",
+			style: "openai",
+			line:  `{"choices":[{"text":"once"}]}`,
+			want:  streamDelta{Content: "once", Output: true},
+		},
+		{
+			name:  "openai usage chunk",
+			style: "openai",
+			line:  `{"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":5,"total_tokens":8}}`,
+			want:  streamDelta{Usage: &usageBlock{PromptTokens: 3, CompletionTokens: 5, TotalTokens: 8}},
+		},
+		{
+			name:  "openai done",
+			style: "openai",
+			line:  "[DONE]",
+			want:  streamDelta{Done: true},
+		},
+		{
+			name:  "ollama content",
+			style: "ollama",
+			line:  `{"message":{"content":"one "},"done":false}`,
+			want:  streamDelta{Content: "one ", Output: true},
+		},
+		{
+			name:  "ollama tool call",
+			style: "ollama",
+			line:  `{"message":{"content":"","tool_calls":[{"function":{"name":"f","arguments":{"x":1}}}]}}`,
+			want:  streamDelta{Output: true, ToolCalls: []streamToolCall{{Type: "function", Name: "f", Arguments: `{"x":1}`}}},
+		},
+		{
+			name:  "ollama final line",
+			style: "ollama",
+			line:  `{"done":true,"done_reason":"stop","prompt_eval_count":4,"eval_count":2,"eval_duration":5000000}`,
+			want:  streamDelta{Ollama: &ollamaResp{PromptEvalCount: 4, EvalCount: 2, EvalDuration: 5000000}, Done: true},
+		},
+		{
+			name:  "gemini text and usage",
+			style: "gemini",
+			line:  `{"candidates":[{"content":{"parts":[{"text":"x"}]}}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":1}}`,
+			want:  streamDelta{Content: "x", Output: true, Usage: &usageBlock{PromptTokens: 4, CompletionTokens: 1, TotalTokens: 5}},
+		},
+		{
+			name:  "cohere text",
+			style: "cohere",
+			line:  `{"event_type":"text-generation","text":"sure"}`,
+			want:  streamDelta{Content: "sure", Output: true},
+		},
+		{
+			name:  "cohere stream end",
+			style: "cohere",
+			line:  `{"event_type":"stream-end","response":{"text":"sure","meta":{"tokens":{"input_tokens":6,"output_tokens":1}}}}`,
+			want:  streamDelta{Usage: &usageBlock{PromptTokens: 6, CompletionTokens: 1, TotalTokens: 7}, Done: true},
+		},
+		{
+			name:  "anthropic message start",
+			style: "anthropic",
+			line:  `{"type":"message_start","message":{"usage":{"input_tokens":9,"output_tokens":1}}}`,
+			want:  streamDelta{Usage: &usageBlock{PromptTokens: 9}},
+		},
+		{
+			name:  "anthropic tool use start",
+			style: "anthropic",
+			line:  `{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"f","input":{}}}`,
+			want:  streamDelta{ToolCalls: []streamToolCall{{ID: "toolu_1", Type: "tool_use", Name: "f"}}},
+		},
+		{
+			name:  "anthropic text delta",
+			style: "anthropic",
+			line:  `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ab"}}`,
+			want:  streamDelta{Content: "ab", Output: true},
+		},
+		{
+			name:  "anthropic arguments delta",
+			style: "anthropic",
+			line:  `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"x\":"}}`,
+			want:  streamDelta{Arguments: `{"x":`, Output: true},
+		},
+		{
+			name:  "anthropic message delta",
+			style: "anthropic",
+			line:  `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":12}}`,
+			want:  streamDelta{Usage: &usageBlock{CompletionTokens: 12}},
+		},
+		{
+			name:  "anthropic stop",
+			style: "anthropic",
+			line:  `{"type":"message_stop"}`,
+			want:  streamDelta{Done: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStreamChunk(tt.style, tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// ToolDeltas are checked through appendToolCalls below.
+			got.ToolDeltas = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStreamChunkMalformed(t *testing.T) {
+	for _, style := range []string{"openai", "ollama", "anthropic", "gemini", "cohere"} {
+		if _, err := parseStreamChunk(style, "<html>proxy error</html>"); err == nil {
+			t.Errorf("%s: no error for a line that isn't JSON", style)
+		}
+	}
+}
+
+func TestParseStreamChunkGeminiSchema(t *testing.T) {
+	if _, err := parseStreamChunk("gemini", `{"candidates":"not a list"}`); err == nil {
+		t.Error("no error for a chunk that doesn't fit the schema")
+	}
+}
+
+func TestStreamDeltaToolCalls(t *testing.T) {
+	openai := []string{
+		`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Oslo\"}"}}]}}]}`,
+	}
+	anthropic := []string{
+		`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"\"Oslo\"}"}}`,
+	}
+	tests := []struct {
+		style string
+		lines []string
+		want  streamToolCall
+	}{
+		{"openai", openai, streamToolCall{ID: "call_1", Type: "function", Name: "get_weather", Arguments: `{"city":"Oslo"}`}},
+		{"anthropic", anthropic, streamToolCall{ID: "toolu_1", Type: "tool_use", Name: "get_weather", Arguments: `{"city":"Oslo"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			var calls []streamToolCall
+			for _, line := range tt.lines {
+				d, err := parseStreamChunk(tt.style, line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				calls = d.appendToolCalls(calls)
+			}
+			if len(calls) != 1 || calls[0] != tt.want {
+				t.Errorf("calls = %+v, want [%+v]", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeUsage(t *testing.T) {
+	var u *usageBlock
+	u = mergeUsage(u, usageBlock{PromptTokens: 9})
+	u = mergeUsage(u, usageBlock{CompletionTokens: 12})
+	if want := (usageBlock{PromptTokens: 9, CompletionTokens: 12}); *u != want {
+		t.Errorf("got %+v, want %+v", *u, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go, so builds stay cgo-free
+)
+
+// sqliteSchema is created on first use. Every invocation adds one
+// benchmarks row and a runs row per successful run, so trends across
+// commits are a join away. Timestamps are RFC 3339 in UTC, which sorts.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS benchmarks (
+	id                INTEGER PRIMARY KEY,
+	label             TEXT NOT NULL,
+	started_at        TEXT NOT NULL,
+	style             TEXT NOT NULL,
+	base_url          TEXT NOT NULL,
+	models            TEXT NOT NULL,
+	stream            INTEGER NOT NULL,
+	tps_mode          TEXT NOT NULL,
+	requests          INTEGER NOT NULL,
+	successful        INTEGER NOT NULL,
+	interrupted       INTEGER NOT NULL,
+	wall_ms           REAL NOT NULL,
+	achieved_rps      REAL NOT NULL,
+	avg_latency_ms    REAL NOT NULL,
+	p50_latency_ms    REAL NOT NULL,
+	p95_latency_ms    REAL NOT NULL,
+	p99_latency_ms    REAL NOT NULL,
+	avg_ttft_ms       REAL,
+	avg_tok_per_sec   REAL NOT NULL,
+	agg_tok_per_sec   REAL NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	cost_usd          REAL NOT NULL
+);
+CREATE TABLE IF NOT EXISTS runs (
+	benchmark_id      INTEGER NOT NULL REFERENCES benchmarks(id),
+	run               INTEGER NOT NULL,
+	turn              INTEGER NOT NULL,
+	model             TEXT NOT NULL,
+	started_at        TEXT NOT NULL,
+	status_code       INTEGER NOT NULL,
+	latency_ms        REAL NOT NULL,
+	ttft_ms           REAL NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	tok_per_sec       REAL NOT NULL,
+	retries           INTEGER NOT NULL,
+	metrics           TEXT NOT NULL -- every per-run field, as in --output json
+);
+CREATE INDEX IF NOT EXISTS runs_benchmark ON runs(benchmark_id);
+`
+
+// sqliteBenchmark is the summary row of one invocation.
+type sqliteBenchmark struct {
+	Label       string
+	StartedAt   time.Time
+	Style       string
+	BaseURL     string
+	Models      []string
+	Stream      bool
+	TPSMode     string
+	Requests    int
+	Interrupted bool
+	Wall        time.Duration
+	AchievedRPS float64
+	Stats       runStats
+}
+
+// storeSQLite appends a benchmark and its runs to the database at path in
+// one transaction, creating the file and schema if needed. It returns the
+// new benchmark's id.
+func storeSQLite(ctx context.Context, path string, b sqliteBenchmark, runs []runMetrics) (int64, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening sqlite database: %w", err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		return 0, fmt.Errorf("error creating sqlite schema: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error writing sqlite database: %w", err)
+	}
+	defer tx.Rollback()
+
+	s := b.Stats
+	var ttft any // NULL unless streamed runs reported one
+	if s.TTFTRuns > 0 {
+		ttft = s.TTFT.Avg
+	}
+	var aggTPS float64
+	if b.Wall > 0 {
+		aggTPS = float64(s.CompletionTokens) / b.Wall.Seconds()
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO benchmarks (
+		label, started_at, style, base_url, models, stream, tps_mode, requests, successful, interrupted,
+		wall_ms, achieved_rps, avg_latency_ms, p50_latency_ms, p95_latency_ms, p99_latency_ms,
+		avg_ttft_ms, avg_tok_per_sec, agg_tok_per_sec, prompt_tokens, completion_tokens, cost_usd
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.Label, b.StartedAt.UTC().Format(time.RFC3339Nano), b.Style, b.BaseURL, strings.Join(b.Models, ","), b.Stream, b.TPSMode,
+		b.Requests, s.Runs, b.Interrupted,
+		float64(b.Wall.Microseconds())/1e3, b.AchievedRPS, s.Latency.Avg, s.Latency.P50, s.Latency.P95, s.Latency.P99,
+		ttft, s.TokPerSec.Avg, aggTPS, s.PromptTokens, s.CompletionTokens, s.CostUSD)
+	if err != nil {
+		return 0, fmt.Errorf("error writing sqlite benchmark row: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error writing sqlite benchmark row: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO runs (
+		benchmark_id, run, turn, model, started_at, status_code, latency_ms, ttft_ms,
+		prompt_tokens, completion_tokens, tok_per_sec, retries, metrics
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("error writing sqlite run rows: %w", err)
+	}
+	defer stmt.Close()
+	for _, m := range runs {
+		metrics, err := json.Marshal(m)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding run %d: %w", m.Run, err)
+		}
+		if _, err := stmt.ExecContext(ctx, id, m.Run, m.Turn, m.Model, m.StartedAt.UTC().Format(time.RFC3339Nano), m.StatusCode,
+			m.LatencyMs, m.TTFTMs, m.PromptTokens, m.CompletionTokens, m.TokPerSec, m.Retries, string(metrics)); err != nil {
+			return 0, fmt.Errorf("error writing sqlite run row: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error writing sqlite database: %w", err)
+	}
+	return id, nil
+}
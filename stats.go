@@ -0,0 +1,611 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sampleSize bounds the runs an aggregator holds for the statistics that
+// can't be kept as running sums, such as percentiles.
+const sampleSize = 10000
+
+// aggregator collects the metrics of successful runs and computes the
+// statistics the summary reports on them. Counts, sums, averages, extremes
+// and standard deviations are kept as running totals; percentiles and the
+// other per-run views come from a uniform sample of at most sampleSize
+// runs, which is every run until there are more. Wave spread is tracked
+// as runs arrive, so it covers every run either way. Every run is kept
+// only when keep is set. It is safe for concurrent use, so a summary can be
+// taken while runs are still coming in. The zero value is ready to use.
+type aggregator struct {
+	mu   sync.Mutex
+	keep bool
+	runs []runMetrics
+
+	sample []runMetrics
+	rng    *rand.Rand
+	waves  waveTracker
+
+	// totals holds counts and sums; summary turns them into averages.
+	totals                                      runStats
+	latency, rate, ttft, itlMean, itlP95        moments
+	sumCompletionTPS, sumTotalTPS, sumPromptTPS float64
+}
+
+func (a *aggregator) add(m runMetrics) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keep {
+		a.runs = append(a.runs, m)
+	}
+	s := &a.totals
+	s.Runs++
+	a.waves.add(m)
+	// Reservoir sampling: run n replaces a random slot with probability
+	// sampleSize/n, which keeps the sample uniform over all runs.
+	if len(a.sample) < sampleSize {
+		a.sample = append(a.sample, m)
+	} else {
+		if a.rng == nil {
+			a.rng = rand.New(rand.NewSource(1))
+		}
+		if i := a.rng.Intn(s.Runs); i < sampleSize {
+			a.sample[i] = m
+		}
+	}
+
+	s.PromptTokens += m.PromptTokens
+	s.CompletionTokens += m.CompletionTokens
+	s.TotalTokens += m.TotalTokens
+	if m.ReasoningTokens > 0 {
+		s.ReasoningTokens += m.ReasoningTokens
+		s.ReasoningRuns++
+	}
+	s.Elapsed += time.Duration(m.LatencyMs) * time.Millisecond
+	a.latency.add(m.LatencyMs)
+	if m.TTFTMs > 0 {
+		a.ttft.add(m.TTFTMs)
+	}
+	if m.RateUndefined {
+		s.Unrated++
+	} else {
+		a.rate.add(m.TokPerSec)
+		a.sumCompletionTPS += m.CompletionTokPerSec
+		a.sumTotalTPS += m.TotalTokPerSec
+		a.sumPromptTPS += m.PromptTokPerSec
+	}
+	if m.PromptTPSBasis != "" {
+		if s.PromptTPSBases == nil {
+			s.PromptTPSBases = map[string]int{}
+		}
+		s.PromptTPSBases[m.PromptTPSBasis]++
+	}
+
+	if m.Retries > 0 {
+		s.Retried++
+		s.Retries += m.Retries
+	}
+	s.CostUSD += m.CostUSD
+	if usefulRun(m) {
+		s.UsefulTokens += m.CompletionTokens
+	} else {
+		s.Empty++
+	}
+
+	if m.PromptTokens > 0 {
+		s.RatioRuns++
+	}
+	if m.PrefillMs > 0 || m.DecodeMs > 0 {
+		s.PrefillMs += m.PrefillMs
+		s.DecodeMs += m.DecodeMs
+		s.SplitRuns++
+	}
+	if m.EvalDurationMs > 0 {
+		s.OllamaTimedRuns++
+		s.LoadMs += m.LoadDurationMs
+		s.MaxLoadMs = max(s.MaxLoadMs, m.LoadDurationMs)
+		s.PromptEvalMs += m.PromptEvalDurationMs
+		s.EvalMs += m.EvalDurationMs
+	}
+	if m.ITLMeanMs > 0 {
+		a.itlMean.add(m.ITLMeanMs)
+		a.itlP95.add(m.ITLP95Ms)
+	}
+	if m.ServerTimeMs > 0 {
+		s.ServerTimeMs += m.ServerTimeMs
+		s.ServerLatencyMs += m.LatencyMs
+		s.ServerTimedRuns++
+	}
+	if m.ConnReused {
+		s.ReusedConns++
+		s.ReusedLatencyMs += m.LatencyMs
+	} else {
+		s.NewConns++
+		s.NewLatencyMs += m.LatencyMs
+		s.ConnectMs += m.ConnectMs
+	}
+	s.ReqBytes += m.ReqBytes
+	s.RespBytes += m.RespBytes
+	if m.RateLimitRemaining != nil {
+		s.QuotaRuns++
+	}
+	if m.Turn >= 1 {
+		for len(s.Turns) < m.Turn {
+			s.Turns = append(s.Turns, turnStats{Turn: len(s.Turns) + 1})
+		}
+		t := &s.Turns[m.Turn-1]
+		t.Runs++
+		t.AvgLatencyMs += m.LatencyMs
+		t.AvgPromptTokens += float64(m.PromptTokens)
+		t.AvgCompletionTokens += float64(m.CompletionTokens)
+		if !m.RateUndefined {
+			t.AvgTokPerSec += m.TokPerSec
+			t.ratedRuns++
+		}
+	}
+}
+
+// all returns every run added so far in arrival order, or nil unless the
+// aggregator keeps them. The slice is shared with the aggregator and must
+// not be modified.
+func (a *aggregator) all() []runMetrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.runs[:len(a.runs):len(a.runs)]
+}
+
+// sampled returns the runs the percentiles are taken from: every run when
+// the aggregator keeps them or there were at most sampleSize, and a uniform
+// sample of sampleSize runs otherwise. The slice must not be modified.
+func (a *aggregator) sampled() []runMetrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keep {
+		return a.runs[:len(a.runs):len(a.runs)]
+	}
+	return slices.Clone(a.sample)
+}
+
+// waveTracker groups runs that started within tolerance of each other into
+// waves and measures each wave's spread: latest minus earliest completion.
+// A large spread between requests that started together points at
+// queueing or contention on the server. Waves are formed greedily in start
+// order, each from its earliest run, but runs arrive in completion order.
+// Runs can only overtake each other while in flight together, so each run
+// waits in pending, ordered by start, until at least sampleSize runs are
+// queued behind it; by then every run of its wave has arrived in any
+// benchmark with fewer requests in flight than that.
+type waveTracker struct {
+	tolerance time.Duration
+	pending   []waveRun
+
+	// open is the wave the last run taken from pending joined, with
+	// openRuns runs so far.
+	open     waveRun
+	openRuns int
+	total    time.Duration
+	waves    int
+}
+
+// waveRun is a run, or a wave of them, reduced to the start of its first
+// run and its earliest and latest completion.
+type waveRun struct {
+	start, first, last time.Time
+}
+
+func (w *waveTracker) add(m runMetrics) {
+	done := m.StartedAt.Add(time.Duration(m.LatencyMs * float64(time.Millisecond)))
+	r := waveRun{start: m.StartedAt, first: done, last: done}
+	i := sort.Search(len(w.pending), func(i int) bool { return w.pending[i].start.After(r.start) })
+	w.pending = slices.Insert(w.pending, i, r)
+	// Draining in batches keeps the cost of removing from the front of
+	// pending constant per run.
+	if len(w.pending) > 2*sampleSize {
+		w.drain(sampleSize)
+	}
+}
+
+// drain moves the earliest-starting runs out of pending into waves until
+// at most keep are left.
+func (w *waveTracker) drain(keep int) {
+	n := len(w.pending) - keep
+	if n <= 0 {
+		return
+	}
+	for _, r := range w.pending[:n] {
+		if w.openRuns > 0 && r.start.Sub(w.open.start) <= w.tolerance {
+			if r.first.Before(w.open.first) {
+				w.open.first = r.first
+			}
+			if r.last.After(w.open.last) {
+				w.open.last = r.last
+			}
+			w.openRuns++
+			continue
+		}
+		w.closeWave()
+		w.open, w.openRuns = r, 1
+	}
+	w.pending = slices.Delete(w.pending, 0, n)
+}
+
+// closeWave counts the open wave if it has two or more runs.
+func (w *waveTracker) closeWave() {
+	if w.openRuns >= 2 {
+		w.total += w.open.last.Sub(w.open.first)
+		w.waves++
+	}
+	w.openRuns = 0
+}
+
+// result returns the mean spread over waves of two or more runs and the
+// number of such waves, counting the runs still pending.
+func (w *waveTracker) result() (time.Duration, int) {
+	c := *w
+	c.pending = slices.Clone(w.pending)
+	c.drain(0)
+	c.closeWave()
+	if c.waves == 0 {
+		return 0, 0
+	}
+	return c.total / time.Duration(c.waves), c.waves
+}
+
+// moments tracks the count, sum, range and variance of a series in
+// constant space, the variance with Welford's online update.
+type moments struct {
+	n             int
+	sum, min, max float64
+	mean, m2      float64
+}
+
+func (m *moments) add(v float64) {
+	m.n++
+	m.sum += v
+	if m.n == 1 {
+		m.min, m.max = v, v
+	} else {
+		m.min, m.max = min(m.min, v), max(m.max, v)
+	}
+	d := v - m.mean
+	m.mean += d / float64(m.n)
+	m.m2 += d * (v - m.mean)
+}
+
+// summary describes the series like newStatSummary, taking the
+// percentiles from sorted, an ascending sample of it.
+func (m moments) summary(sorted []float64) statSummary {
+	if m.n == 0 {
+		return statSummary{}
+	}
+	s := statSummary{
+		Avg: m.sum / float64(m.n),
+		Min: m.min,
+		Max: m.max,
+		P50: percentile(sorted, 50),
+		P90: percentile(sorted, 90),
+		P95: percentile(sorted, 95),
+		P99: percentile(sorted, 99),
+	}
+	if m.n >= 2 {
+		s.StdDev = math.Sqrt(m.m2 / float64(m.n-1))
+		if s.Avg != 0 {
+			s.CV = s.StdDev / s.Avg
+		}
+	}
+	return s
+}
+
+// turnStats averages the runs of one turn of multi-turn sessions.
+type turnStats struct {
+	Turn                int     `json:"turn"`
+	Runs                int     `json:"runs"`
+	AvgLatencyMs        float64 `json:"avg_latency_ms"`
+	AvgPromptTokens     float64 `json:"avg_prompt_tokens"`
+	AvgCompletionTokens float64 `json:"avg_completion_tokens"`
+	AvgTokPerSec        float64 `json:"avg_tok_per_sec"`
+
+	ratedRuns int
+}
+
+// runStats is everything the summary derives from a set of runs. Averages
+// over the runs that reported a metric come with the number of those runs,
+// which is zero when none did.
+type runStats struct {
+	Runs int
+
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	// ReasoningTokens is the part of CompletionTokens spent on reasoning
+	// by the ReasoningRuns runs that reported any.
+	ReasoningTokens int
+	ReasoningRuns   int
+	// Elapsed is the sum of the runs' latencies.
+	Elapsed time.Duration
+
+	Latency   statSummary
+	TokPerSec statSummary
+	// Unrated runs generated no completion tokens or finished too fast for
+	// a rate, and are left out of TokPerSec and the means below.
+	Unrated int
+	// TTFT covers the TTFTRuns streamed runs that produced a token.
+	TTFT     statSummary
+	TTFTRuns int
+	// Per-request means of the other rates. PromptTPSBases counts the runs
+	// by prompt_tps_basis and is empty when no run had a prompt rate.
+	MeanCompletionTokPerSec float64
+	MeanTotalTokPerSec      float64
+	MeanPromptTokPerSec     float64
+	PromptTPSBases          map[string]int
+
+	// Retried runs needed Retries retries between them.
+	Retried int
+	Retries int
+	CostUSD float64
+
+	// UsefulTokens are the completion tokens of runs a user could use
+	// (see usefulRun); Empty counts the runs that delivered nothing.
+	UsefulTokens int
+	Empty        int
+
+	// Completion/prompt token ratio over the RatioRuns runs with a prompt.
+	RatioP10, RatioP50, RatioP90 float64
+	RatioRuns                    int
+
+	PrefillMs, DecodeMs float64
+	SplitRuns           int
+
+	// Ollama's own timings.
+	LoadMs, MaxLoadMs, PromptEvalMs, EvalMs float64
+	OllamaTimedRuns                         int
+
+	// Inter-token latency of streams with more than one chunk: the spread
+	// of the per-run means and p95s.
+	ITLMean, ITLP95 statSummary
+	ITLRuns         int
+
+	ServerTimeMs, ServerLatencyMs float64
+	ServerTimedRuns               int
+
+	NewConns, ReusedConns                    int
+	NewLatencyMs, ReusedLatencyMs, ConnectMs float64
+
+	// Request and response body bytes.
+	ReqBytes, RespBytes int64
+
+	// QuotaCorrelation is the Pearson correlation between the remaining
+	// rate-limit quota and latency over QuotaRuns runs.
+	QuotaCorrelation float64
+	QuotaRuns        int
+
+	// Turns holds turn t of multi-turn sessions at index t-1.
+	Turns []turnStats
+
+	// WaveSpread is the mean spread of completion times over the Waves
+	// waves of two or more runs that started together (see waveTracker).
+	WaveSpread time.Duration
+	Waves      int
+
+	// Sampled is the number of runs the percentiles were taken from: Runs,
+	// unless the runs weren't kept and there were more than sampleSize.
+	Sampled int
+}
+
+// sampleNote labels figures drawn from a sample rather than every run, as
+// in " (sampled, 10000 of 25000 runs)", and is empty when nothing was
+// left out.
+func (s runStats) sampleNote() string {
+	if s.Sampled >= s.Runs {
+		return ""
+	}
+	return fmt.Sprintf(" (sampled, %d of %d runs)", s.Sampled, s.Runs)
+}
+
+// summary computes the statistics of the runs added so far.
+func (a *aggregator) summary() runStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.totals
+	s.PromptTPSBases = maps.Clone(a.totals.PromptTPSBases)
+	if s.PromptTPSBases == nil {
+		s.PromptTPSBases = map[string]int{}
+	}
+	s.Turns = slices.Clone(a.totals.Turns)
+	if s.Runs == 0 {
+		return s
+	}
+
+	sample := a.sample
+	if a.keep {
+		sample = a.runs
+	}
+	s.Sampled = len(sample)
+	s.WaveSpread, s.Waves = a.waves.result()
+	var latencies, rates, ttfts, ratios, itlMeans, itlP95s, quota, quotaLatency []float64
+	for _, m := range sample {
+		latencies = append(latencies, m.LatencyMs)
+		if !m.RateUndefined {
+			rates = append(rates, m.TokPerSec)
+		}
+		if m.TTFTMs > 0 {
+			ttfts = append(ttfts, m.TTFTMs)
+		}
+		if m.PromptTokens > 0 {
+			ratios = append(ratios, float64(m.CompletionTokens)/float64(m.PromptTokens))
+		}
+		if m.ITLMeanMs > 0 {
+			itlMeans = append(itlMeans, m.ITLMeanMs)
+			itlP95s = append(itlP95s, m.ITLP95Ms)
+		}
+		if m.RateLimitRemaining != nil {
+			quota = append(quota, float64(*m.RateLimitRemaining))
+			quotaLatency = append(quotaLatency, m.LatencyMs)
+		}
+	}
+	for _, values := range [][]float64{latencies, rates, ttfts, ratios, itlMeans, itlP95s} {
+		sort.Float64s(values)
+	}
+
+	s.Latency = a.latency.summary(latencies)
+	s.TokPerSec = a.rate.summary(rates)
+	if s.TTFTRuns = a.ttft.n; s.TTFTRuns > 0 {
+		s.TTFT = a.ttft.summary(ttfts)
+	}
+	if n := float64(a.rate.n); n > 0 {
+		s.MeanCompletionTokPerSec = a.sumCompletionTPS / n
+		s.MeanTotalTokPerSec = a.sumTotalTPS / n
+		s.MeanPromptTokPerSec = a.sumPromptTPS / n
+	}
+	if s.RatioRuns > 0 {
+		s.RatioP10, s.RatioP50, s.RatioP90 = percentile(ratios, 10), percentile(ratios, 50), percentile(ratios, 90)
+	}
+	if s.SplitRuns > 0 {
+		s.PrefillMs /= float64(s.SplitRuns)
+		s.DecodeMs /= float64(s.SplitRuns)
+	}
+	if s.OllamaTimedRuns > 0 {
+		s.LoadMs /= float64(s.OllamaTimedRuns)
+		s.PromptEvalMs /= float64(s.OllamaTimedRuns)
+		s.EvalMs /= float64(s.OllamaTimedRuns)
+	}
+	if s.ITLRuns = a.itlMean.n; s.ITLRuns > 0 {
+		s.ITLMean, s.ITLP95 = a.itlMean.summary(itlMeans), a.itlP95.summary(itlP95s)
+	}
+	if s.ServerTimedRuns > 0 {
+		s.ServerTimeMs /= float64(s.ServerTimedRuns)
+		s.ServerLatencyMs /= float64(s.ServerTimedRuns)
+	}
+	if s.NewConns > 0 {
+		s.NewLatencyMs /= float64(s.NewConns)
+		s.ConnectMs /= float64(s.NewConns)
+	}
+	if s.ReusedConns > 0 {
+		s.ReusedLatencyMs /= float64(s.ReusedConns)
+	}
+	if len(quota) >= 2 {
+		s.QuotaCorrelation = pearson(quota, quotaLatency)
+	}
+	for i := range s.Turns {
+		if t := &s.Turns[i]; t.Runs > 0 {
+			t.AvgLatencyMs /= float64(t.Runs)
+			t.AvgPromptTokens /= float64(t.Runs)
+			t.AvgCompletionTokens /= float64(t.Runs)
+			if t.ratedRuns > 0 {
+				t.AvgTokPerSec /= float64(t.ratedRuns)
+			}
+		}
+	}
+	return s
+}
+
+// statSummary describes the spread of one per-run metric.
+type statSummary struct {
+	Avg float64 `json:"avg"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	// StdDev is the sample standard deviation and CV the coefficient of
+	// variation (StdDev / Avg); both are zero for fewer than two values.
+	StdDev float64 `json:"stddev"`
+	CV     float64 `json:"cv"`
+}
+
+func newStatSummary(values []float64) statSummary {
+	if len(values) == 0 {
+		return statSummary{}
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	var total float64
+	for _, v := range sorted {
+		total += v
+	}
+	sd, cv := stddev(sorted)
+	return statSummary{
+		Avg:    total / float64(len(sorted)),
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		P50:    percentile(sorted, 50),
+		P90:    percentile(sorted, 90),
+		P95:    percentile(sorted, 95),
+		P99:    percentile(sorted, 99),
+		StdDev: sd,
+		CV:     cv,
+	}
+}
+
+// percentiles formats the p50/p90/p95/p99.
+func (s statSummary) percentiles() string {
+	return fmt.Sprintf("%.2f / %.2f / %.2f / %.2f", s.P50, s.P90, s.P95, s.P99)
+}
+
+// percentile returns the p-th percentile (0-100) of an ascending slice,
+// interpolating linearly between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// stddev returns the sample standard deviation of values and its
+// coefficient of variation (stddev / mean), which compares the jitter of
+// series with different scales. Both are zero for fewer than two values,
+// and the coefficient is zero when the mean is.
+func stddev(values []float64) (sd, cv float64) {
+	n := float64(len(values))
+	if n < 2 {
+		return 0, 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / n
+	var sq float64
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	sd = math.Sqrt(sq / (n - 1))
+	if mean != 0 {
+		cv = sd / mean
+	}
+	return sd, cv
+}
+
+// pearson returns the Pearson correlation coefficient of xs and ys, or 0 when
+// either series has no variance.
+func pearson(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func approx(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 50, 0},
+		{[]float64{7}, 99, 7},
+		{[]float64{1, 2, 3, 4}, 0, 1},
+		{[]float64{1, 2, 3, 4}, 50, 2.5},
+		{[]float64{1, 2, 3, 4}, 90, 3.7},
+		{[]float64{1, 2, 3, 4}, 100, 4},
+		{[]float64{10, 20, 30, 40, 50}, 25, 20},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); !approx(got, tt.want) {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestStddev(t *testing.T) {
+	tests := []struct {
+		values []float64
+		sd, cv float64
+	}{
+		{nil, 0, 0},
+		{[]float64{3}, 0, 0},
+		{[]float64{4, 4, 4}, 0, 0},
+		{[]float64{2, 4, 4, 4, 5, 5, 7, 9}, 2.138089935299395, 0.427617987059879},
+		{[]float64{-1, 1}, math.Sqrt2, 0}, // zero mean: no coefficient
+	}
+	for _, tt := range tests {
+		sd, cv := stddev(tt.values)
+		if !approx(sd, tt.sd) || !approx(cv, tt.cv) {
+			t.Errorf("stddev(%v) = %v, %v; want %v, %v", tt.values, sd, cv, tt.sd, tt.cv)
+		}
+	}
+}
+
+func TestPearson(t *testing.T) {
+	tests := []struct {
+		name   string
+		xs, ys []float64
+		want   float64
+	}{
+		{"positive", []float64{1, 2, 3}, []float64{2, 4, 6}, 1},
+		{"negative", []float64{1, 2, 3}, []float64{30, 20, 10}, -1},
+		{"partial", []float64{1, 2, 3, 4, 5}, []float64{2, 4, 5, 4, 5}, 0.7745966692414834},
+		{"no variance", []float64{5, 5, 5}, []float64{1, 2, 3}, 0},
+	}
+	for _, tt := range tests {
+		if got := pearson(tt.xs, tt.ys); !approx(got, tt.want) {
+			t.Errorf("%s: pearson = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewStatSummary(t *testing.T) {
+	values := []float64{50, 10, 40, 20, 30}
+	s := newStatSummary(values)
+	want := statSummary{Avg: 30, Min: 10, Max: 50, P50: 30, P90: 46, P95: 48, P99: 49.6, StdDev: math.Sqrt(250), CV: math.Sqrt(250) / 30}
+	for _, f := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"avg", s.Avg, want.Avg}, {"min", s.Min, want.Min}, {"max", s.Max, want.Max},
+		{"p50", s.P50, want.P50}, {"p90", s.P90, want.P90}, {"p95", s.P95, want.P95}, {"p99", s.P99, want.P99},
+		{"stddev", s.StdDev, want.StdDev}, {"cv", s.CV, want.CV},
+	} {
+		if !approx(f.got, f.want) {
+			t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+		}
+	}
+	if values[0] != 50 {
+		t.Errorf("newStatSummary sorted its input: %v", values)
+	}
+	if (newStatSummary(nil) != statSummary{}) {
+		t.Errorf("summary of nothing = %+v, want zero", newStatSummary(nil))
+	}
+}
+
+func TestAggregatorSummary(t *testing.T) {
+	runs := []runMetrics{
+		{Run: 1, Turn: 1, PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30, LatencyMs: 100, TokPerSec: 200,
+			CompletionTokPerSec: 200, TotalTokPerSec: 300, PromptTokPerSec: 100, PromptTPSBasis: "latency",
+			TTFTMs: 40, Retries: 2, CostUSD: 0.5, ConnReused: false, ConnectMs: 8, ReqBytes: 100, RespBytes: 1000},
+		{Run: 1, Turn: 2, PromptTokens: 40, CompletionTokens: 0, TotalTokens: 40, LatencyMs: 300, TokPerSec: 0,
+			PromptTokPerSec: 400, PromptTPSBasis: "ttft", TTFTMs: 100, ConnReused: true, ReqBytes: 200, RespBytes: 10},
+		{Run: 2, Turn: 1, PromptTokens: 10, CompletionTokens: 30, TotalTokens: 40, LatencyMs: 200, TokPerSec: 150,
+			CompletionTokPerSec: 150, TotalTokPerSec: 200, PromptTokPerSec: 100, PromptTPSBasis: "latency",
+			Retries: 1, CostUSD: 0.25, ConnReused: false, ConnectMs: 4, ReqBytes: 100, RespBytes: 2000},
+		// Too fast to time: counted everywhere except the rates.
+		{Run: 3, Turn: 1, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, LatencyMs: 0, RateUndefined: true,
+			PromptTPSBasis: "latency", ConnReused: true},
+	}
+	var agg aggregator
+	for _, m := range runs {
+		agg.add(m)
+	}
+	s := agg.summary()
+
+	ints := []struct {
+		name      string
+		got, want int
+	}{
+		{"runs", s.Runs, 4},
+		{"prompt tokens", s.PromptTokens, 70},
+		{"completion tokens", s.CompletionTokens, 55},
+		{"total tokens", s.TotalTokens, 125},
+		{"unrated", s.Unrated, 1},
+		{"ttft runs", s.TTFTRuns, 2},
+		{"retried", s.Retried, 2},
+		{"retries", s.Retries, 3},
+		{"useful tokens", s.UsefulTokens, 55},
+		{"empty", s.Empty, 1},
+		{"new conns", s.NewConns, 2},
+		{"reused conns", s.ReusedConns, 2},
+		{"req bytes", int(s.ReqBytes), 400},
+		{"resp bytes", int(s.RespBytes), 3010},
+		{"latency bases", s.PromptTPSBases["latency"], 3},
+		{"ttft bases", s.PromptTPSBases["ttft"], 1},
+		{"turns", len(s.Turns), 2},
+	}
+	for _, f := range ints {
+		if f.got != f.want {
+			t.Errorf("%s = %d, want %d", f.name, f.got, f.want)
+		}
+	}
+	floats := []struct {
+		name      string
+		got, want float64
+	}{
+		{"latency avg", s.Latency.Avg, 150},
+		{"latency max", s.Latency.Max, 300},
+		{"latency min", s.Latency.Min, 0},
+		{"tok/s avg", s.TokPerSec.Avg, 350.0 / 3},
+		{"tok/s min", s.TokPerSec.Min, 0},
+		{"mean completion tok/s", s.MeanCompletionTokPerSec, 350.0 / 3},
+		{"mean total tok/s", s.MeanTotalTokPerSec, 500.0 / 3},
+		{"mean prompt tok/s", s.MeanPromptTokPerSec, 200},
+		{"ttft avg", s.TTFT.Avg, 70},
+		{"cost", s.CostUSD, 0.75},
+		{"new conn latency", s.NewLatencyMs, 150},
+		{"reused conn latency", s.ReusedLatencyMs, 150},
+		{"connect", s.ConnectMs, 6},
+		{"turn 1 latency", s.Turns[0].AvgLatencyMs, 100},
+		{"turn 1 tok/s", s.Turns[0].AvgTokPerSec, 175},
+		{"turn 2 prompt tokens", s.Turns[1].AvgPromptTokens, 40},
+	}
+	for _, f := range floats {
+		if !approx(f.got, f.want) {
+			t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestAggregatorEmpty(t *testing.T) {
+	var agg aggregator
+	s := agg.summary()
+	if s.Runs != 0 || s.TokPerSec != (statSummary{}) || s.MeanCompletionTokPerSec != 0 {
+		t.Errorf("summary of no runs = %+v", s)
+	}
+}
+
+func TestMomentsMatchNewStatSummary(t *testing.T) {
+	values := []float64{12, 7, 7, 30, 1.5, 19, 4}
+	var m moments
+	for _, v := range values {
+		m.add(v)
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	got, want := m.summary(sorted), newStatSummary(values)
+	for _, f := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"avg", got.Avg, want.Avg}, {"min", got.Min, want.Min}, {"max", got.Max, want.Max},
+		{"p50", got.P50, want.P50}, {"p99", got.P99, want.P99},
+		{"stddev", got.StdDev, want.StdDev}, {"cv", got.CV, want.CV},
+	} {
+		if !approx(f.got, f.want) {
+			t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestAggregatorBoundsMemory(t *testing.T) {
+	const n = 3 * sampleSize
+	tests := []struct {
+		name           string
+		keep           bool
+		all, sampleLen int
+	}{
+		{"sampled", false, 0, sampleSize},
+		{"kept", true, n, n},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg := aggregator{keep: tt.keep}
+			for i := range n {
+				// Latencies 1..n, so every statistic is known exactly.
+				agg.add(runMetrics{Run: i + 1, LatencyMs: float64(i + 1), CompletionTokens: 2, TokPerSec: 10})
+			}
+			if got := len(agg.all()); got != tt.all {
+				t.Errorf("all() has %d runs, want %d", got, tt.all)
+			}
+			if got := len(agg.sampled()); got != tt.sampleLen {
+				t.Errorf("sampled() has %d runs, want %d", got, tt.sampleLen)
+			}
+
+			s := agg.summary()
+			if s.Runs != n || s.CompletionTokens != 2*n {
+				t.Errorf("runs %d, completion tokens %d; want %d, %d", s.Runs, s.CompletionTokens, n, 2*n)
+			}
+			// Running totals are exact whether or not the runs are kept.
+			if !approx(s.Latency.Avg, (n+1)/2.0) || s.Latency.Min != 1 || s.Latency.Max != n {
+				t.Errorf("latency avg %v min %v max %v", s.Latency.Avg, s.Latency.Min, s.Latency.Max)
+			}
+			if want := math.Sqrt(float64(n) * (n + 1) / 12); math.Abs(s.Latency.StdDev-want) > 1e-6 {
+				t.Errorf("latency stddev %v, want %v", s.Latency.StdDev, want)
+			}
+			// A uniform sample of 10000 puts the percentiles within a
+			// couple of percent of the true ones.
+			for _, p := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"p50", s.Latency.P50, 0.50 * n}, {"p90", s.Latency.P90, 0.90 * n}, {"p99", s.Latency.P99, 0.99 * n},
+			} {
+				if math.Abs(p.got-p.want) > 0.02*n {
+					t.Errorf("latency %s = %v, want about %v", p.name, p.got, p.want)
+				}
+			}
+			if s.TokPerSec.Avg != 10 || s.TokPerSec.P50 != 10 {
+				t.Errorf("tok/s = %+v, want 10 throughout", s.TokPerSec)
+			}
+		})
+	}
+}
+
+// waveSpread is the definition waveTracker has to match: it sorts every run
+// by start, groups the runs that started within tolerance of a wave's first
+// run and returns the mean spread (latest minus earliest completion) over
+// waves of two or more runs, along with the number of such waves.
+func waveSpread(all []runMetrics, tolerance time.Duration) (time.Duration, int) {
+	sorted := make([]runMetrics, len(all))
+	copy(sorted, all)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartedAt.Before(sorted[j].StartedAt) })
+
+	var total time.Duration
+	var waves int
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && sorted[j].StartedAt.Sub(sorted[i].StartedAt) <= tolerance {
+			j++
+		}
+		if j-i >= 2 {
+			var first, last time.Time
+			for _, m := range sorted[i:j] {
+				done := m.StartedAt.Add(time.Duration(m.LatencyMs * float64(time.Millisecond)))
+				if first.IsZero() || done.Before(first) {
+					first = done
+				}
+				if done.After(last) {
+					last = done
+				}
+			}
+			total += last.Sub(first)
+			waves++
+		}
+		i = j
+	}
+	if waves == 0 {
+		return 0, 0
+	}
+	return total / time.Duration(waves), waves
+}
+
+func TestAggregatorWaveSpread(t *testing.T) {
+	const (
+		conc      = 8
+		n         = 3 * sampleSize
+		tolerance = 10 * time.Millisecond
+	)
+	// Waves of conc runs start 50ms apart, each run a few ms after the
+	// wave's first, and take 20-120ms, so waves overlap and runs arrive
+	// well out of start order.
+	rng := rand.New(rand.NewSource(1))
+	base := time.Unix(1700000000, 0)
+	runs := make([]runMetrics, n)
+	for i := range runs {
+		start := base.Add(time.Duration(i/conc)*50*time.Millisecond + time.Duration(rng.Intn(5))*time.Millisecond)
+		runs[i] = runMetrics{Run: i + 1, StartedAt: start, LatencyMs: 20 + 100*rng.Float64()}
+	}
+	done := func(m runMetrics) time.Time {
+		return m.StartedAt.Add(time.Duration(m.LatencyMs * float64(time.Millisecond)))
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return done(runs[i]).Before(done(runs[j])) })
+
+	wantSpread, wantWaves := waveSpread(runs, tolerance)
+	if wantWaves != n/conc {
+		t.Fatalf("reference found %d waves, want %d", wantWaves, n/conc)
+	}
+	for _, keep := range []bool{false, true} {
+		agg := aggregator{keep: keep, waves: waveTracker{tolerance: tolerance}}
+		for _, m := range runs {
+			agg.add(m)
+		}
+		s := agg.summary()
+		if s.WaveSpread != wantSpread || s.Waves != wantWaves {
+			t.Errorf("keep=%v: spread %v over %d waves, want %v over %d", keep, s.WaveSpread, s.Waves, wantSpread, wantWaves)
+		}
+		// Percentiles come from a sample only when the runs aren't kept.
+		if note, want := s.sampleNote(), !keep; (note != "") != want {
+			t.Errorf("keep=%v: sample note %q", keep, note)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// summaryRow is one labelled line of the end-of-run summary.
+type summaryRow struct {
+	Label string
+	Value string
+}
+
+// summaryTable collects the summary lines so the same aggregates can be
+// rendered as aligned text or as a GitHub-flavored markdown table.
+type summaryTable struct {
+	Title string
+	Rows  []summaryRow
+}
+
+func (t *summaryTable) add(label, format string, args ...any) {
+	t.Rows = append(t.Rows, summaryRow{Label: label, Value: fmt.Sprintf(format, args...)})
+}
+
+func (t *summaryTable) write(w io.Writer, format string) {
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### %s\n\n", t.Title)
+		rows := make([][]string, len(t.Rows))
+		for i, r := range t.Rows {
+			rows[i] = []string{r.Label, r.Value}
+		}
+		writeMarkdownTable(w, []string{"Metric", "Value"}, rows)
+		return
+	}
+	fmt.Fprintf(w, "\n=== %s ===\n", t.Title)
+	for _, r := range t.Rows {
+		fmt.Fprintf(w, "%-25s: %s\n", r.Label, r.Value)
+	}
+}
+
+var markdownCellEscaper = strings.NewReplacer("|", `\|`, "\n", " ")
+
+// writeMarkdownTable pads every column to its widest cell so the table also
+// reads well as plain text, and right-aligns columns that hold only numbers.
+func writeMarkdownTable(w io.Writer, header []string, rows [][]string) {
+	all := append([][]string{header}, rows...)
+	for i, r := range all {
+		escaped := make([]string, len(r))
+		for j, c := range r {
+			escaped[j] = markdownCellEscaper.Replace(c)
+		}
+		all[i] = escaped
+	}
+	widths := make([]int, len(header))
+	numeric := make([]bool, len(header))
+	for j := range header {
+		widths[j] = 3
+		numeric[j] = len(rows) > 0
+	}
+	for i, r := range all {
+		for j, c := range r {
+			widths[j] = max(widths[j], utf8.RuneCountInString(c))
+			if i > 0 && !numericCell(c) {
+				numeric[j] = false
+			}
+		}
+	}
+
+	writeMarkdownRow(w, all[0], widths, numeric)
+	sep := make([]string, len(header))
+	for j := range sep {
+		sep[j] = strings.Repeat("-", widths[j])
+		if numeric[j] {
+			sep[j] = sep[j][1:] + ":"
+		}
+	}
+	writeMarkdownRow(w, sep, widths, numeric)
+	for _, r := range all[1:] {
+		writeMarkdownRow(w, r, widths, numeric)
+	}
+}
+
+func writeMarkdownRow(w io.Writer, cells []string, widths []int, right []bool) {
+	padded := make([]string, len(cells))
+	for j, c := range cells {
+		pad := strings.Repeat(" ", max(widths[j]-utf8.RuneCountInString(c), 0))
+		if right[j] {
+			padded[j] = pad + c
+		} else {
+			padded[j] = c + pad
+		}
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(padded, " | "))
+}
+
+// numericCell reports whether a cell is a plain number, optionally a
+// percentage.
+func numericCell(c string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSuffix(c, "%"), 64)
+	return err == nil
+}
+
+// jsonSchemaVersion is the jsonSummary schema_version. It goes up when a
+// field is renamed, removed or changes meaning; new fields don't bump it.
+const jsonSchemaVersion = 2
+
+// jsonSummary is the machine-readable summary printed by --output json.
+// Its field names are versioned by SchemaVersion.
+type jsonSummary struct {
+	SchemaVersion    int             `json:"schema_version"`
+	Requests         int             `json:"requests"`
+	Successful       int             `json:"successful"`
+	Failed           int             `json:"failed"`
+	Interrupted      bool            `json:"interrupted,omitempty"`
+	TPSMode          string          `json:"tps_mode"`
+	PromptTokens     int             `json:"prompt_tokens"`
+	CompletionTokens int             `json:"completion_tokens"`
+	TotalTokens      int             `json:"total_tokens"`
+	ReqBytes         int64           `json:"req_bytes"`
+	RespBytes        int64           `json:"resp_bytes"`
+	ElapsedMs        float64         `json:"elapsed_ms"`
+	WallMs           float64         `json:"wall_ms"`
+	AchievedRPS      float64         `json:"achieved_rps"`
+	LatencyMs        statSummary     `json:"latency_ms"`
+	TokPerSec        statSummary     `json:"tok_per_sec"`
+	TTFTMs           *statSummary    `json:"ttft_ms,omitempty"` // streamed runs only
+	UnratedRuns      int             `json:"unrated_runs,omitempty"`
+	Retries          int             `json:"retries"`
+	RetriedRuns      int             `json:"retried_runs"`
+	CostUSD          *float64        `json:"cost_usd,omitempty"` // with a price set only
+	GoodputTokPerSec float64         `json:"goodput_tok_per_sec"`
+	EmptyRuns        int             `json:"empty_runs"`
+	Dispatch         *dispatchRate   `json:"dispatch,omitempty"` // with --rps only
+	Health           *healthSummary  `json:"health,omitempty"`   // with --healthcheck-interval only
+	Models           []modelSummary  `json:"models,omitempty"`
+	Phases           []phaseSummary  `json:"phases,omitempty"`
+	Windows          []windowSummary `json:"windows,omitempty"`
+	Turns            []turnStats     `json:"turns,omitempty"`
+	StatusCodes      []statusCount   `json:"status_codes,omitempty"`
+	Errors           []errorCount    `json:"errors,omitempty"`
+	Runs             []runMetrics    `json:"runs"`
+}
+
+// dispatchRate compares the rate runs were dispatched at with --rps.
+type dispatchRate struct {
+	AchievedRPS float64 `json:"achieved_rps"`
+	TargetRPS   float64 `json:"target_rps"`
+}
+
+// healthSummary is what the background health probe saw during the run.
+type healthSummary struct {
+	UnhealthyMs  float64 `json:"unhealthy_ms"`
+	Outages      int     `json:"outages"`
+	Probes       int     `json:"probes"`
+	FailedProbes int     `json:"failed_probes"`
+}
+
+// formatBytes renders a byte count in decimal units, matching MB/s.
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2f GB", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.2f MB", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.2f kB", n/1e3)
+	}
+	return fmt.Sprintf("%.0f B", n)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// modelSummary is one model's line in the per-model breakdown printed when
+// --model lists several models.
+type modelSummary struct {
+	Model        string  `json:"model"`
+	Requests     int     `json:"requests"`
+	Successful   int     `json:"successful"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	P95LatencyMs float64 `json:"p95_latency_ms"`
+	AvgTokPerSec float64 `json:"avg_tok_per_sec"`
+}
+
+// newModelSummaries breaks the results down by model. requests holds the
+// requests each model was sent. Successful counts come from all runs and
+// the latency and rate figures from the measured ones.
+func newModelSummaries(models []string, requests map[string]int, all, measured []runMetrics) []modelSummary {
+	rows := make([]modelSummary, len(models))
+	index := make(map[string]int, len(models))
+	for i, model := range models {
+		index[model] = i
+		rows[i] = modelSummary{Model: model, Requests: requests[model]}
+	}
+	for _, m := range all {
+		if i, ok := index[m.Model]; ok {
+			rows[i].Successful++
+		}
+	}
+	latencies := make([][]float64, len(models))
+	rates := make([][]float64, len(models))
+	for _, m := range measured {
+		if i, ok := index[m.Model]; ok {
+			latencies[i] = append(latencies[i], m.LatencyMs)
+			if !m.RateUndefined {
+				rates[i] = append(rates[i], m.TokPerSec)
+			}
+		}
+	}
+	for i := range rows {
+		lat := newStatSummary(latencies[i])
+		rows[i].AvgLatencyMs = lat.Avg
+		rows[i].P95LatencyMs = lat.P95
+		rows[i].AvgTokPerSec = newStatSummary(rates[i]).Avg
+	}
+	return rows
+}
+
+func writeModelSummaries(w io.Writer, format string, rows []modelSummary) {
+	header := []string{"Model", "Successful", "Avg latency ms", "p95 latency ms", "Avg tok/s"}
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### Per model\n\n")
+		cells := make([][]string, len(rows))
+		for i, r := range rows {
+			cells[i] = []string{
+				r.Model, fmt.Sprintf("%d/%d", r.Successful, r.Requests),
+				fmt.Sprintf("%.2f", r.AvgLatencyMs), fmt.Sprintf("%.2f", r.P95LatencyMs), fmt.Sprintf("%.2f", r.AvgTokPerSec),
+			}
+		}
+		writeMarkdownTable(w, header, cells)
+		return
+	}
+	width := len(header[0])
+	for _, r := range rows {
+		width = max(width, len(r.Model))
+	}
+	fmt.Fprintf(w, "\n=== Per model ===\n")
+	fmt.Fprintf(w, "%-*s  %10s  %14s  %14s  %10s\n", width, header[0], header[1], header[2], header[3], header[4])
+	for _, r := range rows {
+		fmt.Fprintf(w, "%-*s  %10s  %14.2f  %14.2f  %10.2f\n", width, r.Model,
+			fmt.Sprintf("%d/%d", r.Successful, r.Requests), r.AvgLatencyMs, r.P95LatencyMs, r.AvgTokPerSec)
+	}
+}
+
+// phaseSummary is one side of the cold start vs steady state comparison.
+type phaseSummary struct {
+	Phase        string  `json:"phase"`
+	Runs         int     `json:"runs"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	P95LatencyMs float64 `json:"p95_latency_ms"`
+	AvgTTFTMs    float64 `json:"avg_ttft_ms"`
+	AvgTokPerSec float64 `json:"avg_tok_per_sec"`
+}
+
+// newPhaseSummaries splits runs into a cold bucket and the steady state
+// after it. The cold bucket is the --warmup runs when there were any, and
+// otherwise the first 10% (at least one) of the measured batch by start
+// time. It returns nil when either bucket would be empty.
+func newPhaseSummaries(warm, all []runMetrics) []phaseSummary {
+	cold, steady := warm, all
+	label := "Warmup"
+	if len(warm) == 0 {
+		if len(all) < 2 {
+			return nil
+		}
+		sorted := make([]runMetrics, len(all))
+		copy(sorted, all)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].StartedAt.Before(sorted[j].StartedAt) })
+		k := max(len(sorted)/10, 1)
+		cold, steady = sorted[:k], sorted[k:]
+		label = "First 10%"
+	}
+	if len(cold) == 0 || len(steady) == 0 {
+		return nil
+	}
+	return []phaseSummary{newPhaseSummary(label, cold), newPhaseSummary("Steady state", steady)}
+}
+
+func newPhaseSummary(name string, runs []runMetrics) phaseSummary {
+	latencies := make([]float64, 0, len(runs))
+	ttfts := make([]float64, 0, len(runs))
+	rates := make([]float64, 0, len(runs))
+	for _, m := range runs {
+		latencies = append(latencies, m.LatencyMs)
+		if !m.RateUndefined {
+			rates = append(rates, m.TokPerSec)
+		}
+		if m.TTFTMs > 0 {
+			ttfts = append(ttfts, m.TTFTMs)
+		}
+	}
+	lat := newStatSummary(latencies)
+	return phaseSummary{
+		Phase:        name,
+		Runs:         len(runs),
+		AvgLatencyMs: lat.Avg,
+		P95LatencyMs: lat.P95,
+		AvgTTFTMs:    newStatSummary(ttfts).Avg,
+		AvgTokPerSec: newStatSummary(rates).Avg,
+	}
+}
+
+// writePhaseSummaries prints the phases side by side, one column each, with
+// the TTFT row only for streamed runs. note is appended to the title, to
+// say when the phases were split from a sample.
+func writePhaseSummaries(w io.Writer, format string, phases []phaseSummary, stream bool, note string) {
+	header := []string{"Metric"}
+	runs := []string{"Runs"}
+	latency := []string{"Avg latency ms"}
+	p95 := []string{"p95 latency ms"}
+	ttft := []string{"Avg TTFT ms"}
+	rate := []string{"Avg tok/s"}
+	for _, p := range phases {
+		header = append(header, p.Phase)
+		runs = append(runs, fmt.Sprintf("%d", p.Runs))
+		latency = append(latency, fmt.Sprintf("%.2f", p.AvgLatencyMs))
+		p95 = append(p95, fmt.Sprintf("%.2f", p.P95LatencyMs))
+		ttft = append(ttft, fmt.Sprintf("%.2f", p.AvgTTFTMs))
+		rate = append(rate, fmt.Sprintf("%.2f", p.AvgTokPerSec))
+	}
+	rows := [][]string{runs, latency, p95}
+	if stream {
+		rows = append(rows, ttft)
+	}
+	rows = append(rows, rate)
+
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### Cold start vs steady state%s\n\n", note)
+		writeMarkdownTable(w, header, rows)
+		return
+	}
+	fmt.Fprintf(w, "\n=== Cold start vs steady state%s ===\n", note)
+	for _, r := range append([][]string{header}, rows...) {
+		fmt.Fprintf(w, "%-25s", r[0])
+		for _, cell := range r[1:] {
+			fmt.Fprintf(w, "  %14s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// windowSummary is one time slice of a --ramp benchmark, so the point
+// where latency bends as concurrency rises can be read off.
+type windowSummary struct {
+	FromS float64 `json:"from_s"`
+	ToS   float64 `json:"to_s"`
+	// ConcurrencyFrom and ConcurrencyTo are the limits the ramp set at the
+	// window's start and end.
+	ConcurrencyFrom int     `json:"concurrency_from"`
+	ConcurrencyTo   int     `json:"concurrency_to"`
+	Successful      int     `json:"successful"`
+	AvgLatencyMs    float64 `json:"avg_latency_ms"`
+	P95LatencyMs    float64 `json:"p95_latency_ms"`
+	AvgTokPerSec    float64 `json:"avg_tok_per_sec"`
+}
+
+// newWindowSummaries splits runs by start time into n equal windows between
+// start and the last run's start. Windows without runs are left out.
+func newWindowSummaries(runs []runMetrics, start time.Time, n int, ramp rampSchedule) []windowSummary {
+	if len(runs) == 0 || n < 1 {
+		return nil
+	}
+	var span time.Duration
+	for _, m := range runs {
+		span = max(span, m.StartedAt.Sub(start))
+	}
+	width := span / time.Duration(n)
+	latencies := make([][]float64, n)
+	rates := make([][]float64, n)
+	for _, m := range runs {
+		i := n - 1
+		if width > 0 {
+			i = min(int(m.StartedAt.Sub(start)/width), n-1)
+		}
+		latencies[i] = append(latencies[i], m.LatencyMs)
+		if !m.RateUndefined {
+			rates[i] = append(rates[i], m.TokPerSec)
+		}
+	}
+	var rows []windowSummary
+	for i := range n {
+		if len(latencies[i]) == 0 {
+			continue
+		}
+		from, to := width*time.Duration(i), width*time.Duration(i+1)
+		if i == n-1 {
+			to = span
+		}
+		lat := newStatSummary(latencies[i])
+		rows = append(rows, windowSummary{
+			FromS:           from.Seconds(),
+			ToS:             to.Seconds(),
+			ConcurrencyFrom: ramp.at(from),
+			ConcurrencyTo:   ramp.at(to),
+			Successful:      len(latencies[i]),
+			AvgLatencyMs:    lat.Avg,
+			P95LatencyMs:    lat.P95,
+			AvgTokPerSec:    newStatSummary(rates[i]).Avg,
+		})
+	}
+	return rows
+}
+
+func writeWindowSummaries(w io.Writer, format string, rows []windowSummary) {
+	header := []string{"Window", "Concurrency", "Successful", "Avg latency ms", "p95 latency ms", "Avg tok/s"}
+	cells := make([][]string, len(rows))
+	for i, r := range rows {
+		conc := fmt.Sprintf("%d", r.ConcurrencyFrom)
+		if r.ConcurrencyTo != r.ConcurrencyFrom {
+			conc = fmt.Sprintf("%d-%d", r.ConcurrencyFrom, r.ConcurrencyTo)
+		}
+		cells[i] = []string{
+			fmt.Sprintf("%.1fs-%.1fs", r.FromS, r.ToS), conc, fmt.Sprintf("%d", r.Successful),
+			fmt.Sprintf("%.2f", r.AvgLatencyMs), fmt.Sprintf("%.2f", r.P95LatencyMs), fmt.Sprintf("%.2f", r.AvgTokPerSec),
+		}
+	}
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### Ramp windows\n\n")
+		writeMarkdownTable(w, header, cells)
+		return
+	}
+	width := len(header[0])
+	for _, c := range cells {
+		width = max(width, len(c[0]))
+	}
+	fmt.Fprintf(w, "\n=== Ramp windows ===\n")
+	fmt.Fprintf(w, "%-*s  %11s  %10s  %14s  %14s  %10s\n", width, header[0], header[1], header[2], header[3], header[4], header[5])
+	for _, c := range cells {
+		fmt.Fprintf(w, "%-*s  %11s  %10s  %14s  %14s  %10s\n", width, c[0], c[1], c[2], c[3], c[4], c[5])
+	}
+}
+
+// writeHistogram draws an ASCII histogram of values split into buckets of
+// equal width between their min and max, with bars scaled to the fullest
+// bucket, so bimodal latency shows up where a single percentile hides it.
+func writeHistogram(w io.Writer, format, title, unit string, values []float64, buckets int) {
+	if len(values) == 0 || buckets < 1 {
+		return
+	}
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	if hi == lo {
+		buckets = 1
+	}
+	counts := make([]int, buckets)
+	width := (hi - lo) / float64(buckets)
+	for _, v := range values {
+		i := buckets - 1
+		if width > 0 {
+			i = min(int((v-lo)/width), buckets-1)
+		}
+		counts[i]++
+	}
+	peak := 0
+	for _, n := range counts {
+		peak = max(peak, n)
+	}
+
+	const barWidth = 40
+	if format == "markdown" {
+		fmt.Fprintf(w, "\n### %s\n\n```\n", title)
+	} else {
+		fmt.Fprintf(w, "\n=== %s ===\n", title)
+	}
+	for i, n := range counts {
+		from := lo + float64(i)*width
+		bar := strings.Repeat("#", (n*barWidth+peak-1)/peak)
+		fmt.Fprintf(w, "%10.2f - %10.2f %s | %-*s %d\n", from, from+width, unit, barWidth, bar, n)
+	}
+	if format == "markdown" {
+		fmt.Fprintf(w, "```\n")
+	}
+}
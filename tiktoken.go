@@ -0,0 +1,47 @@
+//go:build tiktoken
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// tiktokenTokenizer counts BPE tokens with an OpenAI encoding. The
+// vocabularies are embedded, so nothing is downloaded at startup.
+type tiktokenTokenizer struct {
+	enc      *tiktoken.Tiktoken
+	encoding string
+}
+
+func (t tiktokenTokenizer) count(text string) int { return len(t.enc.EncodeOrdinary(text)) }
+func (t tiktokenTokenizer) String() string        { return "tiktoken/" + t.encoding }
+
+// newTiktokenTokenizer loads encoding, or the one tiktoken maps model to
+// when encoding is empty.
+func newTiktokenTokenizer(encoding, model string) (tokenizer, error) {
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	if encoding == "" {
+		var ok bool
+		encoding, ok = tiktoken.MODEL_TO_ENCODING[model]
+		if !ok {
+			for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+				if strings.HasPrefix(model, prefix) {
+					encoding, ok = name, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("no tiktoken encoding known for model %q (use tiktoken:cl100k_base or tiktoken:o200k_base)", model)
+		}
+	}
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tiktoken encoding %q: %w", encoding, err)
+	}
+	return tiktokenTokenizer{enc: enc, encoding: encoding}, nil
+}
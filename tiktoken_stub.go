@@ -0,0 +1,11 @@
+//go:build !tiktoken
+
+package main
+
+import "errors"
+
+var errTiktokenUnsupported = errors.New("tiktoken support is not compiled in; rebuild with -tags tiktoken")
+
+func newTiktokenTokenizer(encoding, model string) (tokenizer, error) {
+	return nil, errTiktokenUnsupported
+}
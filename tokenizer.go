@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// tokenizer counts the tokens in prompt and generated text wherever the
+// server doesn't report usage itself.
+type tokenizer interface {
+	count(text string) int
+	String() string
+}
+
+// activeTokenizer is resolved once at startup by --tokenizer and shared by
+// every run.
+var activeTokenizer tokenizer = whitespaceTokenizer{}
+
+func countTokens(text string) int {
+	return activeTokenizer.count(text)
+}
+
+// whitespaceTokenizer counts whitespace-separated words. It undercounts real
+// BPE tokens considerably but needs no vocabulary.
+type whitespaceTokenizer struct{}
+
+func (whitespaceTokenizer) count(text string) int { return len(strings.Fields(text)) }
+func (whitespaceTokenizer) String() string        { return "whitespace" }
+
+var errUnknownTokenizer = errors.New("unknown tokenizer")
+
+// newTokenizer resolves a --tokenizer value: "whitespace", "tiktoken" (the
+// encoding is picked from the model name) or "tiktoken:ENCODING", e.g.
+// tiktoken:o200k_base.
+func newTokenizer(spec, model string) (tokenizer, error) {
+	kind, encoding, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "whitespace":
+		return whitespaceTokenizer{}, nil
+	case "tiktoken":
+		return newTiktokenTokenizer(encoding, model)
+	default:
+		return nil, fmt.Errorf("%w %q: want whitespace, tiktoken or tiktoken:ENCODING", errUnknownTokenizer, spec)
+	}
+}